@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A daemon or rpc server given -audit appends records of every request it
+// gets to an audit log: who asked, when, a digest of the pattern rather
+// than the pattern, and the roots. A search is recorded as started before
+// it runs, and again when done, with how many hits were found; a request
+// refused, for a bad token or a root outside -allow, say, is recorded with
+// why. Each record carries a digest of itself chained to the record before
+// it, keyed with -audit-key, so that a record edited, dropped or reordered
+// afterwards breaks the chain, as rtgrep audit reports. The pattern digest
+// is keyed too, so that patterns, often short, cannot be found by hashing
+// guesses without the key. A search whose start cannot be recorded is not
+// run, so that nothing is searched unaudited.
+
+// An auditEntry is a record in the audit log, one JSON object per line.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`         // start, done or refused
+	User      string    `json:"user"`          // who asked, by name if known
+	UID       string    `json:"uid,omitempty"` // and by id
+	Pattern   string    `json:"pattern"`       // HMAC-SHA-256 of the pattern, in hex
+	Roots     []string  `json:"roots"`
+	Hits      int       `json:"hits,omitempty"` // when done
+	Truncated string    `json:"truncated,omitempty"`
+	Err       string    `json:"error,omitempty"` // of a search, or why a request was refused
+	Hash      string    `json:"hash"`            // of the previous entry's Hash and this entry
+}
+
+// An auditLog appends entries to an audit log. It is safe for concurrent
+// use; a nil *auditLog records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	sync func() error // if set, makes what was written durable
+	key  []byte
+	prev string // hash of the last entry
+}
+
+// openAudit opens the audit log at dest, a file to append to or syslog,
+// with the key in keyFile. Appending to a file continues the chain of the
+// entries already in it.
+func openAudit(dest, keyFile string) (*auditLog, error) {
+	a := new(auditLog)
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if a.key = bytes.TrimSpace(key); len(a.key) == 0 {
+		return nil, fmt.Errorf("audit key %s is empty", keyFile)
+	}
+	if dest == "syslog" {
+		w, err := openSyslog()
+		if err != nil {
+			return nil, fmt.Errorf("audit: %v", err)
+		}
+		a.w = w
+		return a, nil
+	}
+	f, err := os.OpenFile(dest, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if a.prev, err = lastAuditHash(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s: %v", dest, err)
+	}
+	a.w, a.sync = f, f.Sync
+	return a, nil
+}
+
+// lastAuditHash returns the hash of the last entry read from r, or "" if
+// there is none.
+func lastAuditHash(r io.Reader) (string, error) {
+	var last auditEntry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			return "", err
+		}
+	}
+	return last.Hash, sc.Err()
+}
+
+// chain returns the hash of e, without its Hash, following prev.
+func chain(key []byte, prev string, e auditEntry) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(prev))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// record appends e to the log, stamped with the time and chained to the
+// previous entry.
+func (a *auditLog) record(e auditEntry) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Time = time.Now()
+	hash, err := chain(a.key, a.prev, e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	if a.sync != nil {
+		if err := a.sync(); err != nil {
+			return fmt.Errorf("audit: %v", err)
+		}
+	}
+	a.prev = hash
+	return nil
+}
+
+// search records the search of r by the user with the given id as started,
+// runs it with run, records it as done and returns its results. It returns
+// an error, without running the search, if its start cannot be recorded,
+// and without its results if its end cannot.
+func (a *auditLog) search(uid string, r *request, run func() ([]hit, stats, error)) ([]hit, stats, error) {
+	if a == nil {
+		return run()
+	}
+	e := a.entry("start", uid, r)
+	if err := a.record(e); err != nil {
+		log.Print(err)
+		return nil, stats{}, err
+	}
+	m, st, err := run()
+	e.Event, e.Hits, e.Truncated = "done", len(m), st.Truncated
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if aerr := a.record(e); aerr != nil {
+		log.Print(aerr)
+		return nil, stats{}, aerr
+	}
+	return m, st, err
+}
+
+// refuse records that the request r of the user with the given id was
+// refused, for err.
+func (a *auditLog) refuse(uid string, r *request, err error) {
+	if a == nil {
+		return
+	}
+	e := a.entry("refused", uid, r)
+	e.Err = err.Error()
+	if aerr := a.record(e); aerr != nil {
+		log.Print(aerr)
+	}
+}
+
+// entry returns the entry of event for the request r of the user with the
+// given id.
+func (a *auditLog) entry(event, uid string, r *request) auditEntry {
+	return auditEntry{
+		Event:   event,
+		User:    userName(uid),
+		UID:     uid,
+		Pattern: a.patternDigest(r),
+		Roots:   r.Roots,
+	}
+}
+
+// patternDigest returns the HMAC-SHA-256, in hex, keyed with a's key, of
+// what r searches for: its pattern, or with -jsonl-field, its field and
+// pattern.
+func (a *auditLog) patternDigest(r *request) string {
+	p := r.Pattern
+	if r.JSONLField != "" {
+		p = r.JSONLField
+	}
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte("pattern\x00")) // apart from the digests of the chain
+	h.Write([]byte(p))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// userName returns the name of the user with the given id, or the id if
+// the name cannot be found.
+func userName(uid string) string {
+	if uid == "" {
+		return "unknown"
+	}
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// selfUID returns the id of the user running rtgrep.
+func selfUID() string {
+	if u, err := user.Current(); err == nil {
+		return u.Uid
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		return strconv.Itoa(uid)
+	}
+	return ""
+}
+
+// verifyAudit checks the chain of the entries read from r, with key, and
+// returns how many there are, or an error for the first that breaks it.
+func verifyAudit(r io.Reader, key []byte) (int, error) {
+	var prev string
+	n := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		want, err := chain(key, prev, e)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		if e.Hash != want {
+			return n, fmt.Errorf("line %d: the chain is broken: the entry, or one before it, was changed, removed or reordered", line)
+		}
+		prev = e.Hash
+		n++
+	}
+	return n, sc.Err()
+}
+
+// audit runs rtgrep audit: it checks the chain of an audit log file.
+func audit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	keyFile := fs.String("key", "", "file with the key the log was written with, as given to -audit-key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: rtgrep audit [-key file] log")
+	}
+	var key []byte
+	if *keyFile != "" {
+		b, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = bytes.TrimSpace(b)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	n, err := verifyAudit(f, key)
+	if err != nil {
+		log.Fatalf("%s: %v", fs.Arg(0), err)
+	}
+	fmt.Printf("%s: %d entries, chain intact\n", fs.Arg(0), n)
+}
+
+// auditFlags adds the flags of an audit log to fs, and returns a function
+// opening the log they give, nil if none is.
+func auditFlags(fs *flag.FlagSet) func() *auditLog {
+	dest := fs.String("audit", "", "append a record of every request, chained by hashes, to this file, or to syslog if syslog; needs -audit-key")
+	keyFile := fs.String("audit-key", "", "with -audit, key the hashes with the secret in this file, so that only its holders can forge records or check guesses of the patterns searched for")
+	return func() *auditLog {
+		if *dest == "" {
+			if *keyFile != "" {
+				log.Fatal("-audit-key needs -audit")
+			}
+			return nil
+		}
+		if *keyFile == "" {
+			log.Fatal("-audit needs -audit-key")
+		}
+		a, err := openAudit(*dest, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return a
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// peerUID returns the id of the user at the other end of conn, a unix
+// socket, or "" if it cannot be told.
+func peerUID(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return strconv.Itoa(int(cred.Uid))
+}
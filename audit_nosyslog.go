@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog reports that there is no system log on this platform.
+func openSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
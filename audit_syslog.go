@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog returns a writer of audit records to the system log, under
+// the auth facility.
+func openSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "rtgrep")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// -blame annotates matching lines with the commit that last changed them,
+// as git blame tells. Running git is slow next to searching, so a blamer
+// runs it once per file for all the lines wanted, only a few runs at a
+// time, and keeps what it learned for later searches of the same content.
+//
+// It runs the git command rather than blaming with go-git: go-git and its
+// many dependencies would have to be vendored for this one flag, and a
+// repository worth blaming comes with a git to blame it with. A file git
+// cannot blame, or a tree without git installed, is reported unblamed.
+//
+// git honors the config of the repository it runs in, which can make it run
+// programs of that repository's choosing, as core.fsmonitor does. Searching
+// on its own, a user trusts the trees they search. A daemon runs git as
+// its own user for clients picking the roots, so it blames only below the
+// trees its owner gave it with -allow, and refuses -blame without them.
+
+const (
+	// maxBlamed bounds the files whose blames a blamer keeps.
+	maxBlamed = 256
+
+	// blameRuns is how many git blame processes a blamer runs at once.
+	blameRuns = 4
+)
+
+// A blame is the last commit to change a line.
+type blame struct {
+	Commit string    `json:"commit"`
+	Author string    `json:"author"`
+	Date   time.Time `json:"date"`
+}
+
+// A blamer blames lines with git. It is safe for concurrent use.
+type blamer struct {
+	runs chan struct{}
+
+	mu    sync.Mutex
+	files map[string]map[int]*blame // by path and checksum of content, then line; nil if git cannot tell
+}
+
+func newBlamer() *blamer {
+	return &blamer{runs: make(chan struct{}, blameRuns), files: make(map[string]map[int]*blame)}
+}
+
+// annotate sets the Blame of lines, found in data, the content of the file
+// at path, for the lines git can blame. Lines not yet blamed when ctx is
+// done are left as they are.
+func (b *blamer) annotate(ctx context.Context, path string, data []byte, lines []line) {
+	key := fmt.Sprintf("%s\x00%08x", path, crc32.ChecksumIEEE(data))
+	b.mu.Lock()
+	known := b.files[key]
+	var missing []int
+	for _, l := range lines {
+		if _, ok := known[l.N]; !ok {
+			missing = append(missing, l.N)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(missing) > 0 {
+		select {
+		case b.runs <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		blamed, _ := gitBlame(ctx, path, missing)
+		<-b.runs
+		if ctx.Err() != nil {
+			// Cut short, rather than refused by git.
+			return
+		}
+		b.mu.Lock()
+		known = b.files[key]
+		if known == nil {
+			if len(b.files) >= maxBlamed {
+				b.files = make(map[string]map[int]*blame)
+			}
+			known = make(map[int]*blame)
+			b.files[key] = known
+		}
+		for _, n := range missing {
+			known[n] = blamed[n]
+		}
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	for i := range lines {
+		lines[i].Blame = known[lines[i].N]
+	}
+	b.mu.Unlock()
+}
+
+// gitBlame runs git blame on the given lines of the file at path, in its
+// directory, and returns their blames by line.
+func gitBlame(ctx context.Context, path string, lines []int) (map[int]*blame, error) {
+	args := []string{"-C", filepath.Dir(path), "blame", "--porcelain"}
+	for _, n := range lines {
+		args = append(args, "-L", fmt.Sprintf("%d,%d", n, n))
+	}
+	args = append(args, "--", filepath.Base(path))
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseBlame(out), nil
+}
+
+// parseBlame returns the blames by line in the output of git blame
+// --porcelain. Each line comes with a header of the commit, its line in
+// that commit and its line now, and the commit's details the first time it
+// appears.
+func parseBlame(out []byte) map[int]*blame {
+	commits := make(map[string]*blame)
+	blamed := make(map[int]*blame)
+	var cur *blame
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(l, "\t") {
+			// The line itself.
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) >= 3 && (len(f[0]) == 40 || len(f[0]) == 64) && strings.Trim(f[0], "0123456789abcdef") == "" {
+			cur = commits[f[0]]
+			if cur == nil {
+				cur = &blame{Commit: f[0]}
+				commits[f[0]] = cur
+			}
+			if n, err := strconv.Atoi(f[2]); err == nil {
+				blamed[n] = cur
+			}
+			continue
+		}
+		if cur == nil || len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "author":
+			cur.Author = strings.TrimPrefix(l, "author ")
+		case "author-time":
+			if secs, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+				cur.Date = time.Unix(secs, 0)
+			}
+		case "author-tz":
+			if tz, err := time.Parse("-0700", f[1]); err == nil {
+				cur.Date = cur.Date.In(tz.Location())
+			}
+		}
+	}
+	return blamed
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A clock tells the time and runs timers for search, so that tests can
+// make time pass at will.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+
+	// WithTimeout is context.WithTimeout on the clock's time.
+	WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+// A timer is the part of *time.Timer a clock returns.
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+func (realClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, d)
+}
+
+// A virtualClock is a clock whose time only moves when told to, for tests
+// and for replaying traces. It is safe for concurrent use.
+type virtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	c      *virtualClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+// newVirtualClock returns a virtualClock showing the time start.
+func newVirtualClock(start time.Time) *virtualClock { return &virtualClock{now: start} }
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &virtualTimer{c: c, when: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	was := t.active
+	t.when, t.active = t.c.now.Add(d), true
+	return was
+}
+
+// advance moves the time on by d and runs the timers that come due, in
+// order.
+func (c *virtualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.advanceLocked(c.now.Add(d))
+}
+
+// advanceTo moves the time on to t, if it is not already past it, as
+// advance does.
+func (c *virtualClock) advanceTo(t time.Time) {
+	c.mu.Lock()
+	if t.Before(c.now) {
+		t = c.now
+	}
+	c.advanceLocked(t)
+}
+
+// advanceLocked sets the time to t and unlocks c.mu before running the
+// timers that came due.
+func (c *virtualClock) advanceLocked(t time.Time) {
+	c.now = t
+	var due []*virtualTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (c *virtualClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	dc := &deadlineCtx{Context: ctx, deadline: c.Now().Add(d)}
+	t := c.AfterFunc(d, func() {
+		atomic.StoreInt32(&dc.expired, 1)
+		cancel()
+	})
+	return dc, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// deadlineCtx is the context of virtualClock.WithTimeout.
+type deadlineCtx struct {
+	context.Context
+	deadline time.Time
+	expired  int32
+}
+
+func (c *deadlineCtx) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *deadlineCtx) Err() error {
+	if atomic.LoadInt32(&c.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
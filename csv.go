@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// csvSeparators maps the extensions of delimited-text files to their field
+// separator.
+var csvSeparators = map[string]rune{
+	".csv": ',',
+	".tsv": '\t',
+}
+
+// csvColumns are the columns -column restricts matching to, by header name
+// or 1-based index.
+type csvColumns []string
+
+func parseCSVColumns(s string) csvColumns {
+	return csvColumns(strings.Split(s, ","))
+}
+
+// indexes returns the 0-based indexes of cols in a file with the given
+// header row.
+func (cols csvColumns) indexes(header []string) map[int]bool {
+	idx := make(map[int]bool)
+	for _, col := range cols {
+		if i, err := strconv.Atoi(col); err == nil && i > 0 {
+			idx[i-1] = true
+			continue
+		}
+		for i, name := range header {
+			if strings.TrimSpace(name) == col {
+				idx[i] = true
+			}
+		}
+	}
+	return idx
+}
+
+// named reports whether any of cols is given by name, so that files must
+// start with a header row.
+func (cols csvColumns) named() bool {
+	for _, col := range cols {
+		if i, err := strconv.Atoi(col); err != nil || i <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCSV is match for CSV and TSV files when q has columns: it reports
+// whether any of the columns of any row matches, and returns the matching
+// rows, numbered from the header as 1, if q asks for line numbers. ok is
+// false if name is not a CSV or TSV file or does not parse, and the file
+// should be matched as plain text.
+func (q *query) matchCSV(name string, data []byte) (found bool, lines []line, ok bool) {
+	sep, ok := csvSeparators[filepath.Ext(name)]
+	if !ok {
+		return false, nil, false
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = sep
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fq := *q
+	fq.columns, fq.lineNumbers, fq.scope, fq.goScope = nil, false, anyText, ""
+
+	var cols map[int]bool
+	for n := 1; ; n++ {
+		start := r.InputOffset()
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, nil, false
+		}
+		if cols == nil {
+			cols = q.columns.indexes(row)
+			if q.columns.named() {
+				// The first row is a header, not data.
+				continue
+			}
+		}
+		matched := false
+		for i := range cols {
+			if i < len(row) {
+				if m, _ := fq.match(name, []byte(row[i])); m {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			continue
+		}
+		if !q.lineNumbers {
+			return true, nil, true
+		}
+		text := bytes.TrimRight(data[start:r.InputOffset()], "\r\n")
+		lines = append(lines, line{N: n, Text: clipLine(text, 0, 0, q.maxLine)})
+	}
+	return len(lines) > 0, lines, true
+}
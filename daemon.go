@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// daemonGrace is how much longer than the search timeout a client waits for
+// the daemon's answer.
+const daemonGrace = time.Second
+
+// errNoDaemon is returned by searchDaemon if no daemon is listening.
+var errNoDaemon = errors.New("no rtgrep daemon running")
+
+// A response is the daemon's answer to a request: the hits, or with a
+// Limit, a page of them, out of Total. Cursor, if set, is to be sent back
+// for the next page.
+type response struct {
+	Hits   []hit
+	Total  int
+	Cursor string
+	Stats  stats
+	Err    string
+}
+
+// pageTTL is how long a daemon keeps the hits left to page through after
+// a page is asked for, and maxCursors how many searches' hits it keeps.
+const (
+	pageTTL    = time.Minute
+	maxCursors = 64
+)
+
+// A paged is the hits of a search left for a client to page through.
+// Pages come from them rather than from searching again, which might
+// find other hits and so skip or repeat some.
+type paged struct {
+	uid     string // of the client, the only one to page through them
+	hits    []hit
+	total   int
+	stats   stats
+	expires time.Time
+}
+
+// socketPath returns the unix socket the daemon listens on:
+// $RTGREP_SOCKET if set, or else rtgrep.sock in $XDG_RUNTIME_DIR, or in a
+// directory of the user's own in the temporary directory. Only the user
+// may enter the directories of the last two, as privateDir checks, so that
+// nobody else can listen there in the daemon's place and be sent every
+// search.
+func socketPath() string {
+	if s := os.Getenv("RTGREP_SOCKET"); s != "" {
+		return s
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "rtgrep.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("rtgrep-%d", os.Getuid()), "rtgrep.sock")
+}
+
+// privateDir creates dir if need be, and checks that it is a directory
+// that only the user owns and may enter.
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || !privateToSelf(info) {
+		return fmt.Errorf("%s is not a directory private to this user", dir)
+	}
+	return nil
+}
+
+// An allowList is the trees a daemon searches, with the ceilings on the
+// searches of each; an empty one allows every tree. It is the flag.Value
+// of -allow.
+type allowList []allowedTree
+
+// An allowedTree is a directory, resolved as by resolvePath, and the
+// longest a search below it may run and how many bytes of files it may
+// read, zero for no ceiling.
+type allowedTree struct {
+	dir      string
+	timeout  time.Duration
+	maxBytes int64
+}
+
+func (a *allowList) String() string {
+	var dirs []string
+	for _, t := range *a {
+		dirs = append(dirs, t.dir)
+	}
+	return strings.Join(dirs, " ")
+}
+
+// Set adds the tree given by s: a directory, optionally after ceilings on
+// the searches below it, as in timeout=10s,max-bytes=1G,/srv/src. The
+// directory takes the rest of s, commas and all.
+func (a *allowList) Set(s string) error {
+	var t allowedTree
+	dir := s
+	for {
+		i, j := strings.IndexByte(dir, ','), strings.IndexByte(dir, '=')
+		if i < 0 || j < 0 || j > i {
+			break
+		}
+		key, value := dir[:j], dir[j+1:i]
+		if key != "timeout" && key != "max-bytes" {
+			// A directory with = and , in its name.
+			break
+		}
+		var err error
+		if key == "timeout" {
+			if t.timeout, err = time.ParseDuration(value); err == nil && t.timeout <= 0 {
+				err = fmt.Errorf("%q is not a positive duration", value)
+			}
+		} else {
+			t.maxBytes, err = parseSize(value)
+		}
+		if err != nil {
+			return fmt.Errorf("bad %s in -allow %q: %v", key, s, err)
+		}
+		dir = dir[i+1:]
+	}
+	t.dir = resolvePath(dir)
+	*a = append(*a, t)
+	return nil
+}
+
+// check returns an error for the first of roots outside every tree in a.
+// Symbolic links found below a root are not followed, and a daemon with an
+// allowList runs every search with -contain, so a root inside a tree keeps
+// the search inside it, even if a directory is swapped for a link.
+func (a allowList) check(roots []string) error {
+	if len(a) == 0 {
+		return nil
+	}
+	for _, root := range roots {
+		if _, ok := a.tree(resolvePath(root)); !ok {
+			return fmt.Errorf("%s is not below a tree this daemon searches", root)
+		}
+	}
+	return nil
+}
+
+// tree returns the innermost tree of a that path is in.
+func (a allowList) tree(path string) (t allowedTree, ok bool) {
+	for _, u := range a {
+		if within(u.dir, path) && (!ok || len(u.dir) > len(t.dir)) {
+			t, ok = u, true
+		}
+	}
+	return t, ok
+}
+
+// limit lowers the timeout and byte budget of r to the ceilings of the
+// trees its roots are in.
+func (a allowList) limit(r *request) {
+	for _, root := range r.Roots {
+		t, _ := a.tree(resolvePath(root))
+		if t.timeout > 0 && (r.Timeout <= 0 || r.Timeout > t.timeout) {
+			r.Timeout = t.timeout
+		}
+		if t.maxBytes > 0 && (r.MaxBytes == 0 || r.MaxBytes > t.maxBytes) {
+			r.MaxBytes = t.maxBytes
+		}
+	}
+}
+
+// A daemonServer answers the requests of the daemon's clients.
+type daemonServer struct {
+	s     *searcher
+	audit *auditLog
+	allow allowList
+	token []byte // if set, what requests must carry to be answered
+
+	mu      sync.Mutex
+	cursors map[string]*paged
+}
+
+// authorize checks the token r carries against srv's, if it has one, and
+// removes it from r, so that it goes no further.
+func (srv *daemonServer) authorize(r *request) error {
+	token := r.Token
+	r.Token = ""
+	if srv.token != nil && subtle.ConstantTimeCompare([]byte(token), srv.token) != 1 {
+		return errors.New("the daemon wants the token set in $RTGREP_TOKEN, which this request lacks or gets wrong")
+	}
+	return nil
+}
+
+// daemon runs rtgrep daemon: it answers requests on a unix socket, keeping
+// the directory listings it reads in memory so that later searches of the
+// same trees skip the walk of the disk.
+func daemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := fs.String("socket", socketPath(), "unix socket to listen on")
+	revalidate := fs.Duration("revalidate", 5*time.Second, "how often to check cached directories that cannot be watched for changes")
+	var allow allowList
+	fs.Var(&allow, "allow", "search only below this directory, repeatable; requests for other roots are refused. Ceilings on the searches below it may come first, as in timeout=10s,max-bytes=1G,/srv/src. Without -allow, -blame is refused, as git runs in the repositories of the roots clients pick")
+	tokenFile := fs.String("token", "", "answer only requests carrying the secret in this file, which clients set in $RTGREP_TOKEN")
+	openAudit := auditFlags(fs)
+	fs.Parse(args)
+	srv := &daemonServer{audit: openAudit(), allow: allow}
+	if *tokenFile != "" {
+		b, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if srv.token = bytes.TrimSpace(b); len(srv.token) == 0 {
+			log.Fatalf("token %s is empty", *tokenFile)
+		}
+	}
+
+	if os.Getenv("RTGREP_SOCKET") == "" && *socket == socketPath() {
+		if err := privateDir(filepath.Dir(*socket)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if conn, err := net.Dial("unix", *socket); err == nil {
+		conn.Close()
+		log.Fatalf("a daemon is already listening on %s", *socket)
+	}
+	os.Remove(*socket)
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	c := newDirCache(*revalidate)
+	srv.s = newSearcher(c.walk)
+	srv.s.ignore = c.ignore
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Print(err)
+			continue
+		}
+		go srv.serve(conn)
+	}
+}
+
+// serve answers the request read from conn.
+func (srv *daemonServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var r request
+	if err := json.NewDecoder(conn).Decode(&r); err != nil {
+		if err != io.EOF {
+			log.Print(err)
+		}
+		return
+	}
+	uid := peerUID(conn)
+	var resp response
+	err := srv.authorize(&r)
+	if err == nil && r.Cursor != "" {
+		srv.reply(conn, &resp, srv.next(&resp, uid, r.Cursor, r.Limit))
+		return
+	}
+	if err == nil {
+		err = srv.allow.check(r.Roots)
+	}
+	if err == nil && r.Blame && len(srv.allow) == 0 {
+		err = errors.New("this daemon runs -blame only below the trees given to it with -allow")
+	}
+	var q *query
+	if err == nil {
+		r.Contain = r.Contain || len(srv.allow) > 0
+		srv.allow.limit(&r)
+		q, err = r.query()
+	}
+	if err != nil {
+		srv.audit.refuse(uid, &r, err)
+	} else {
+		s := srv.s
+		ctx, cancel := s.clock.WithTimeout(context.Background(), r.Timeout)
+		defer cancel()
+		// A client sends nothing after its request, so a read that returns
+		// means it has hung up, and the search is of use to nobody.
+		hungUp := make(chan struct{})
+		go func() {
+			conn.Read(make([]byte, 1))
+			close(hungUp)
+			cancel()
+		}()
+		var m []hit
+		m, resp.Stats, err = srv.audit.search(uid, &r, func() ([]hit, stats, error) {
+			return s.search(ctx, r.Roots, q)
+		})
+		select {
+		case <-hungUp:
+			return
+		default:
+		}
+		srv.page(&resp, uid, &paged{hits: m, total: len(m), stats: resp.Stats}, r.Limit)
+	}
+	srv.reply(conn, &resp, err)
+}
+
+// reply sends resp, with err if not nil, on conn.
+func (srv *daemonServer) reply(conn net.Conn, resp *response, err error) {
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Print(err)
+	}
+}
+
+// page sets resp to the first limit of the hits of p, or all of them if
+// limit is 0, and keeps the rest for the client with the given id under a
+// new cursor, which it sets in resp.
+func (srv *daemonServer) page(resp *response, uid string, p *paged, limit int) {
+	resp.Hits, resp.Total, resp.Stats = p.hits, p.total, p.stats
+	if limit <= 0 || limit >= len(p.hits) {
+		return
+	}
+	resp.Hits = p.hits[:limit]
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Print(err)
+		return
+	}
+	cursor := hex.EncodeToString(b)
+	now := srv.s.clock.Now()
+	rest := &paged{uid: uid, hits: p.hits[limit:], total: p.total, stats: p.stats, expires: now.Add(pageTTL)}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.cursors == nil {
+		srv.cursors = make(map[string]*paged)
+	}
+	var oldest string
+	for c, kept := range srv.cursors {
+		if now.After(kept.expires) {
+			delete(srv.cursors, c)
+		} else if oldest == "" || kept.expires.Before(srv.cursors[oldest].expires) {
+			oldest = c
+		}
+	}
+	if len(srv.cursors) >= maxCursors {
+		delete(srv.cursors, oldest)
+	}
+	srv.cursors[cursor] = rest
+	resp.Cursor = cursor
+}
+
+// next sets resp to the page after the one that gave the client with the
+// given id cursor, limit hits long, or the rest if limit is 0. A cursor is
+// good for one page.
+func (srv *daemonServer) next(resp *response, uid, cursor string, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("bad limit %d", limit)
+	}
+	srv.mu.Lock()
+	p := srv.cursors[cursor]
+	delete(srv.cursors, cursor)
+	srv.mu.Unlock()
+	if p == nil || p.uid != uid || srv.s.clock.Now().After(p.expires) {
+		return errors.New("unknown or expired cursor: search again")
+	}
+	srv.page(resp, uid, p, limit)
+	return nil
+}
+
+// searchDaemon runs r on the daemon listening on socketPath, or returns
+// errNoDaemon if there is none. Unless $RTGREP_SOCKET names a daemon to
+// trust, it also returns errNoDaemon, with a warning, for a socket in a
+// directory others may enter, or one not listened on by the user's own
+// daemon, where it can tell.
+func searchDaemon(r *request) ([]hit, stats, error) {
+	path := socketPath()
+	trusted := os.Getenv("RTGREP_SOCKET") != ""
+	if !trusted {
+		if _, err := os.Lstat(filepath.Dir(path)); err != nil {
+			return nil, stats{}, errNoDaemon
+		}
+		if err := privateDir(filepath.Dir(path)); err != nil {
+			log.Printf("not using the daemon: %v", err)
+			return nil, stats{}, errNoDaemon
+		}
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, stats{}, errNoDaemon
+	}
+	defer conn.Close()
+	if uid := peerUID(conn); !trusted && uid != "" && uid != strconv.Itoa(os.Getuid()) {
+		log.Printf("not using the daemon: %s is listened on by uid %s", path, uid)
+		return nil, stats{}, errNoDaemon
+	}
+	conn.SetDeadline(time.Now().Add(r.Timeout + daemonGrace))
+
+	// The daemon has its own working directory, so send it absolute roots
+	// and make the paths it returns relative to the given roots again.
+	abs := *r
+	abs.Token = os.Getenv("RTGREP_TOKEN")
+	abs.Roots = make([]string, len(r.Roots))
+	for i, root := range r.Roots {
+		if abs.Roots[i], err = filepath.Abs(root); err != nil {
+			return nil, stats{}, err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(&abs); err != nil {
+		return nil, stats{}, err
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, stats{}, err
+	}
+	if resp.Err != "" {
+		return nil, stats{}, errors.New(resp.Err)
+	}
+	for i := range resp.Hits {
+		h := &resp.Hits[i]
+		for j, root := range abs.Roots {
+			rel, err := filepath.Rel(root, h.Path)
+			if err == nil && !strings.HasPrefix(rel, "..") {
+				h.Path = filepath.Join(r.Roots[j], rel)
+				break
+			}
+		}
+	}
+	return resp.Hits, resp.Stats, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+)
+
+// -def ranks the files where the pattern is likely defined above those that
+// only refer to it, by matching the text around each match against
+// templates of definitions: func <pattern> in Go, def <pattern> in Python,
+// and so on. It is a guess from one line of text, with no index and no
+// parsing, meant to get close to jumping to a definition.
+
+// A defTemplate recognizes a definition of the name that follows before,
+// which ends where the name starts, on the same line.
+type defTemplate struct {
+	before *regexp.Regexp
+	after  *regexp.Regexp // if set, must match the rest of the line
+}
+
+func defRe(before, after string) defTemplate {
+	t := defTemplate{before: regexp.MustCompile(before + `$`)}
+	if after != "" {
+		t.after = regexp.MustCompile(`^` + after)
+	}
+	return t
+}
+
+// genericDefs are definitions by keyword, as most languages have them.
+var genericDefs = []defTemplate{
+	defRe(`(^|[\s(])(fn|func|function|def|defn|class|struct|enum|union|trait|type|interface|protocol|module|impl|sub|proc|macro|namespace|object)\s+`, ""),
+	defRe(`(^|\s)(let|const|val|var)\s+(mut\s+)?`, ""),
+}
+
+// defTemplates are definitions peculiar to languages, by syntax.
+var defTemplates = map[*syntax][]defTemplate{
+	goSyntax: {
+		defRe(`(^|\s)func\s+(\([^)]*\)\s*)?`, ""),
+	},
+	cSyntax: {
+		defRe(`#\s*define\s+`, ""),
+		// A function definition: a type, then the name and parameters,
+		// with no semicolon to make it a call or a declaration.
+		defRe(`^\s*[A-Za-z_][\w\s*&:<>,\[\]]*[\s*&]`, `\s*\([^;]*$`),
+	},
+	jsSyntax: {
+		defRe(`(^|\s)function\*?\s+`, ""),
+		// A method: the name at the start of the line, then the
+		// parameters and the body.
+		defRe(`^\s*((async|static|get|set|public|private|protected|readonly)\s+)*`, `\s*\([^;]*\)\s*(:[^;{]*)?\{`),
+	},
+	pythonSyntax: {
+		defRe(`^\s*(async\s+)?def\s+`, ""),
+		// An assignment at the top level of a module.
+		defRe(`^`, `\s*(:[^=]*)?=[^=]`),
+	},
+	shellSyntax: {
+		defRe(`^\s*`, `\s*\(\)`),
+	},
+}
+
+// otherCode are the extensions of the source files of other languages,
+// which only have genericDefs.
+var otherCode = map[string]bool{
+	".rs": true, ".rb": true, ".php": true, ".swift": true, ".scala": true,
+	".lua": true, ".pl": true, ".pm": true, ".ex": true, ".exs": true,
+	".hs": true, ".ml": true, ".clj": true, ".dart": true, ".zig": true,
+	".nim": true, ".jl": true, ".r": true, ".erl": true, ".fs": true,
+}
+
+// defTemplatesOf returns the templates of definitions in the file named
+// name, or nil if it is not source code.
+func defTemplatesOf(name string) []defTemplate {
+	if syn := syntaxOf(name); syn != nil {
+		return append(defTemplates[syn], genericDefs...)
+	}
+	if otherCode[filepath.Ext(name)] {
+		return genericDefs
+	}
+	return nil
+}
+
+// isDef reports whether line[i:j], a match in line, is the name in a
+// definition, by one of templates.
+func isDef(templates []defTemplate, line []byte, i, j int) bool {
+	before, after := line[:i], bytes.TrimRight(line[j:], "\r")
+	for _, t := range templates {
+		if t.before.Match(before) && (t.after == nil || t.after.Match(after)) {
+			return true
+		}
+	}
+	return false
+}
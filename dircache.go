@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A dirCache remembers directory listings across searches. Listings are
+// dropped when their directory changes, as reported by the platform's
+// directory watcher or, for directories that cannot be watched, by comparing
+// modification times periodically.
+type dirCache struct {
+	mu      sync.Mutex
+	dirs    map[string]*cachedDir
+	watch   func(dir string) error // nil if there is no watcher
+	listDir func(dir string) ([]os.FileInfo, error)
+
+	// gens counts the invalidations of each directory, and epoch those
+	// of every directory at once, so that a listing read while its
+	// directory changed is not cached.
+	gens  map[string]uint64
+	epoch uint64
+
+	// own are the files searches left out as rtgrep's own, whose changes
+	// do not drop listings.
+	own map[string]bool
+}
+
+const (
+	// maxOwn bounds the own files a dirCache remembers.
+	maxOwn = 1024
+
+	// maxGens bounds the directories a dirCache counts invalidations of.
+	maxGens = 1 << 16
+)
+
+type cachedDir struct {
+	list    []os.FileInfo
+	mod     time.Time
+	watched bool
+}
+
+// newDirCache returns an empty dirCache that revalidates unwatched
+// directories every interval.
+func newDirCache(interval time.Duration) *dirCache {
+	c := &dirCache{
+		dirs:    make(map[string]*cachedDir),
+		listDir: ioutil.ReadDir,
+		gens:    make(map[string]uint64),
+		own:     make(map[string]bool),
+	}
+	watch, err := newWatcher(c.invalidate, c.invalidateAll)
+	if err != nil {
+		log.Printf("watching directories: %v; revalidating every %v instead", err, interval)
+	}
+	c.watch = watch
+	go c.revalidate(interval)
+	return c
+}
+
+// readDir returns the listing of dir, reading it from disk if it is not
+// cached.
+func (c *dirCache) readDir(dir string) ([]os.FileInfo, error) {
+	c.mu.Lock()
+	d, ok := c.dirs[dir]
+	gen, epoch := c.gens[dir], c.epoch
+	c.mu.Unlock()
+	if ok {
+		return d.list, nil
+	}
+
+	// Watch before reading, so that no change goes unnoticed between the
+	// two.
+	watched := c.watch != nil && c.watch(dir) == nil
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	// A change reported during the read may be missing from list.
+	if c.gens[dir] == gen && c.epoch == epoch {
+		c.dirs[dir] = &cachedDir{list, info.ModTime(), watched}
+	}
+	c.mu.Unlock()
+	return list, nil
+}
+
+// invalidate drops the listing of dir after a change to the entry name in
+// it, or to dir itself if name is empty, unless the entry is one of
+// rtgrep's own files.
+func (c *dirCache) invalidate(dir, name string) {
+	c.mu.Lock()
+	if name == "" || !c.own[filepath.Join(dir, name)] {
+		delete(c.dirs, dir)
+		if len(c.gens) >= maxGens {
+			c.gens = make(map[string]uint64)
+			c.epoch++
+		}
+		c.gens[dir]++
+	}
+	c.mu.Unlock()
+}
+
+// ignore adds paths to the files whose changes invalidate lets through.
+func (c *dirCache) ignore(paths []string) {
+	c.mu.Lock()
+	if len(c.own)+len(paths) > maxOwn {
+		c.own = make(map[string]bool)
+	}
+	for _, path := range paths {
+		c.own[path] = true
+	}
+	c.mu.Unlock()
+}
+
+// invalidateAll drops every listing, for when changes may have been missed.
+func (c *dirCache) invalidateAll() {
+	c.mu.Lock()
+	c.dirs = make(map[string]*cachedDir)
+	c.epoch++
+	c.mu.Unlock()
+}
+
+// revalidate drops the listings of unwatched directories whose modification
+// time changed, every interval, forever.
+func (c *dirCache) revalidate(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		var dirs []string
+		for dir, d := range c.dirs {
+			if !d.watched {
+				dirs = append(dirs, dir)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, dir := range dirs {
+			info, err := os.Stat(dir)
+			c.mu.Lock()
+			if d, ok := c.dirs[dir]; ok && (err != nil || !info.ModTime().Equal(d.mod)) {
+				delete(c.dirs, dir)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// walk is a walker like walkDisk that reads directories through c.
+func (c *dirCache) walk(root string, fn walkFunc) error {
+	return walkTree(root, c.readDir, fn)
+}
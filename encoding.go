@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// encodingSample is how much of each file -detect-encodings looks at.
+const encodingSample = 8 << 10
+
+// boms are the byte order marks detectEncoding recognizes, longest first
+// where one is a prefix of another.
+var boms = []struct {
+	bom  []byte
+	name string
+}{
+	{[]byte{0xFF, 0xFE, 0x00, 0x00}, "utf-32le bom"},
+	{[]byte{0x00, 0x00, 0xFE, 0xFF}, "utf-32be bom"},
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8 bom"},
+	{[]byte{0xFF, 0xFE}, "utf-16le bom"},
+	{[]byte{0xFE, 0xFF}, "utf-16be bom"},
+}
+
+// detectEncoding guesses the encoding of a file from a sample of its start.
+func detectEncoding(sample []byte) string {
+	for _, b := range boms {
+		if bytes.HasPrefix(sample, b.bom) {
+			return b.name
+		}
+	}
+	if len(sample) == 0 {
+		return "empty"
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		// Mostly-ASCII UTF-16 text has a NUL in every other byte.
+		even, odd := 0, 0
+		for i, c := range sample {
+			if c == 0 && i%2 == 0 {
+				even++
+			} else if c == 0 {
+				odd++
+			}
+		}
+		switch {
+		case odd > len(sample)*2/5 && even == 0:
+			return "utf-16le (no bom)"
+		case even > len(sample)*2/5 && odd == 0:
+			return "utf-16be (no bom)"
+		}
+		return "binary"
+	}
+	ascii := true
+	for _, c := range sample {
+		if c >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return "ascii"
+	}
+	// The sample may end in the middle of a rune.
+	if utf8.Valid(trimPartialRune(sample)) {
+		return "utf-8"
+	}
+	return "8-bit (not utf-8)"
+}
+
+// trimPartialRune cuts an incomplete UTF-8 sequence off the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// detectEncodings samples the files below roots matching filepattern,
+// listed by walk, until ctx is done, and counts the encodings found per
+// file extension. Files and directories that vanish or cannot be read, as
+// a search would skip them, are left out and counted in skipped.
+func detectEncodings(ctx context.Context, roots []string, filepattern string, walk walker) (counts map[string]map[string]int, skipped int, err error) {
+	files, err := compileGlob(filepattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	counts = make(map[string]map[string]int)
+	buf := make([]byte, encodingSample)
+	for _, root := range roots {
+		skip := func(path string, err error) bool {
+			if vanished(err) && path != root || errors.Is(err, os.ErrPermission) || isTransient(err) || isTooLong(err) {
+				skipped++
+				return true
+			}
+			return false
+		}
+		err := walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if skip(path, err) {
+					return nil
+				}
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if !files.MatchString(globPath(root, path)) {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				if skip(path, err) {
+					return nil
+				}
+				return err
+			}
+			n, err := io.ReadFull(f, buf)
+			f.Close()
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				if skip(path, err) {
+					return nil
+				}
+				return err
+			}
+			ext := filepath.Ext(path)
+			if counts[ext] == nil {
+				counts[ext] = make(map[string]int)
+			}
+			counts[ext][detectEncoding(buf[:n])]++
+			return nil
+		})
+		if err == context.DeadlineExceeded {
+			// Report what was sampled before the deadline.
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return counts, skipped, nil
+}
+
+// printEncodings prints one line per extension of the counts returned by
+// detectEncodings, most common encoding first.
+func printEncodings(w io.Writer, counts map[string]map[string]int) {
+	exts := make([]string, 0, len(counts))
+	for ext := range counts {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		encs := make([]string, 0, len(counts[ext]))
+		for enc := range counts[ext] {
+			encs = append(encs, enc)
+		}
+		sort.Slice(encs, func(i, j int) bool {
+			ci, cj := counts[ext][encs[i]], counts[ext][encs[j]]
+			return ci > cj || ci == cj && encs[i] < encs[j]
+		})
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "%s\t", name)
+		for i, enc := range encs {
+			if i > 0 {
+				fmt.Fprint(w, ", ")
+			}
+			fmt.Fprintf(w, "%s: %d", enc, counts[ext][enc])
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "math"
+
+// High-entropy strings are looked for in runs of base64 and hex characters
+// at least minBlob long. Entropy is measured over a window sliding along
+// the run, or over the whole run if it is shorter than the window, so that
+// a key embedded in a longer run of text is still found.
+const (
+	minBlob       = 16
+	entropyWindow = 32
+)
+
+// xlogx holds x·log2(x) for the counts a window can hold.
+var xlogx [entropyWindow + 1]float64
+
+func init() {
+	for x := 1; x <= entropyWindow; x++ {
+		xlogx[x] = float64(x) * math.Log2(float64(x))
+	}
+}
+
+// isBlobByte reports whether c can be part of a base64 (standard or URL
+// alphabet) or hex string.
+func isBlobByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '+' || c == '/' || c == '=' || c == '-' || c == '_'
+}
+
+// entropySpans returns the start and end offsets of the runs of base64 and
+// hex characters in data with a Shannon entropy of at least threshold bits
+// per character, in order.
+func entropySpans(data []byte, threshold float64) [][2]int {
+	var spans [][2]int
+	for i := 0; i < len(data); {
+		if !isBlobByte(data[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(data) && isBlobByte(data[j]) {
+			j++
+		}
+		if j-i >= minBlob && maxEntropy(data[i:j]) >= threshold {
+			spans = append(spans, [2]int{i, j})
+		}
+		i = j
+	}
+	return spans
+}
+
+// maxEntropy returns the highest entropy, in bits per character, of any
+// window of run.
+func maxEntropy(run []byte) float64 {
+	w := entropyWindow
+	if len(run) < w {
+		w = len(run)
+	}
+	// The entropy of a window of w characters, counted in count, is
+	// log2(w) - sum(c·log2(c))/w over the counts c.
+	var count [256]int
+	sum := 0.0
+	add := func(c byte, d int) {
+		n := count[c]
+		sum += xlogx[n+d] - xlogx[n]
+		count[c] = n + d
+	}
+	for _, c := range run[:w] {
+		add(c, 1)
+	}
+	low := sum
+	for i := w; i < len(run); i++ {
+		add(run[i-w], -1)
+		add(run[i], 1)
+		if sum < low {
+			low = sum
+		}
+	}
+	return math.Log2(float64(w)) - low/float64(w)
+}
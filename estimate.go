@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Before a search, rtgrep guesses how much there is to search, by probing
+// a few random paths down the tree: each probe lists one directory per
+// level, and counts what it finds there once for every directory the
+// levels above it stand for. Averaged over the probes, that estimates the
+// whole tree (Knuth, Estimating the efficiency of backtrack programs,
+// 1975) at the cost of a few listings.
+
+const (
+	// estimateProbes is how many random paths down each root are listed,
+	// unless estimateTime runs out first.
+	estimateProbes = 256
+	estimateTime   = 100 * time.Millisecond
+
+	// estimateFiles and estimateBytes are the rough rates at which a
+	// search gets through files and bytes.
+	estimateFiles = 20000
+	estimateBytes = 200 << 20
+
+	// hopeless is how many times longer than the timeout a search must be
+	// expected to take for rtgrep to warn before starting it.
+	hopeless = 100
+)
+
+// An estimate is a forecast of the work a search faces.
+type estimate struct {
+	files float64            // files whose names match the file pattern
+	bytes float64            // their size
+	exts  map[string]float64 // their size by extension
+}
+
+// estimateTree estimates the files below roots that match files,
+// listing directories with readDir and choosing where to go with rnd. It
+// stops probing a root at the deadline, if there is one.
+func estimateTree(roots []string, files *regexp.Regexp, readDir func(dir string) ([]os.FileInfo, error), rnd *rand.Rand, deadline time.Time) estimate {
+	est := estimate{exts: make(map[string]float64)}
+	listed := make(map[string][]os.FileInfo)
+	// count adds what a file found stands for to sum.
+	count := func(sum *estimate, root, path string, info os.FileInfo, weight float64) {
+		if info.Mode().IsRegular() && files.MatchString(globPath(root, path)) {
+			sum.files += weight
+			sum.bytes += weight * float64(info.Size())
+			sum.exts[filepath.Ext(info.Name())] += weight * float64(info.Size())
+		}
+	}
+	for _, root := range roots {
+		list, err := readDir(root)
+		if err != nil {
+			// root may be a file.
+			if info, err := os.Lstat(root); err == nil {
+				count(&est, root, root, info, 1)
+			}
+			continue
+		}
+		listed[root] = list
+		sum := estimate{exts: make(map[string]float64)}
+		n := 0
+		for ; n < estimateProbes && (deadline.IsZero() || time.Now().Before(deadline)); n++ {
+			dir, weight := root, 1.0
+			for {
+				list, ok := listed[dir]
+				if !ok {
+					list, _ = readDir(dir)
+					listed[dir] = list
+				}
+				var subdirs []string
+				for _, info := range list {
+					if info.IsDir() {
+						subdirs = append(subdirs, filepath.Join(dir, info.Name()))
+					} else {
+						count(&sum, root, filepath.Join(dir, info.Name()), info, weight)
+					}
+				}
+				if len(subdirs) == 0 {
+					break
+				}
+				weight *= float64(len(subdirs))
+				dir = subdirs[rnd.Intn(len(subdirs))]
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		est.files += sum.files / float64(n)
+		est.bytes += sum.bytes / float64(n)
+		for ext, b := range sum.exts {
+			est.exts[ext] += b / float64(n)
+		}
+	}
+	return est
+}
+
+// duration returns how long searching what est counts should take.
+func (est estimate) duration() time.Duration {
+	secs := est.files/estimateFiles + est.bytes/estimateBytes
+	return time.Duration(secs * float64(time.Second))
+}
+
+// warning returns a warning with suggestions if est is hopeless within
+// timeout, or "" if not.
+func (est estimate) warning(timeout time.Duration) string {
+	d := est.duration()
+	if d <= hopeless*timeout {
+		return ""
+	}
+	w := fmt.Sprintf("about %s files, %s, to search: that takes about %v, far more than the %v timeout\n",
+		approx(est.files), approxBytes(est.bytes), d.Round(time.Second), timeout)
+	w += "  raise -timeout, or narrow the search with -g, -since, -max-mem or fewer paths"
+	exts := make([]string, 0, len(est.exts))
+	for ext := range est.exts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool { return est.exts[exts[i]] > est.exts[exts[j]] })
+	var most []string
+	for _, ext := range exts {
+		share := est.exts[ext] / est.bytes
+		if len(most) == 3 || share < 0.1 {
+			break
+		}
+		name := "*" + ext
+		if ext == "" {
+			name = "files without an extension"
+		}
+		most = append(most, fmt.Sprintf("%s (%.0f%%)", name, 100*share))
+	}
+	if len(most) > 0 {
+		w += "; most of the bytes are in " + strings.Join(most, ", ")
+	}
+	return w
+}
+
+// approx formats n with a k, M or G suffix.
+func approx(n float64) string {
+	for _, u := range []struct {
+		n      float64
+		suffix string
+	}{{1e9, "G"}, {1e6, "M"}, {1e3, "k"}} {
+		if n >= u.n {
+			return fmt.Sprintf("%.1f%s", n/u.n, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%.0f", n)
+}
+
+// approxBytes formats the byte count n in KiB, MiB, GiB or TiB.
+func approxBytes(n float64) string {
+	for _, u := range []struct {
+		n      float64
+		suffix string
+	}{{1 << 40, "TiB"}, {1 << 30, "GiB"}, {1 << 20, "MiB"}, {1 << 10, "KiB"}} {
+		if n >= u.n {
+			return fmt.Sprintf("%.1f %s", n/u.n, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%.0f bytes", n)
+}
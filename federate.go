@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// -federate runs a search on several hosts at once, each by rtgrep rpc
+// started over ssh, and merges their hits as they arrive, every path
+// prefixed with its host, as host:path. Roots are paths on the hosts. The
+// search's timeout holds for all of them: a host that has not answered
+// shortly after it is cut off, and reported along with those that failed.
+
+// federateGrace is how much longer than the search timeout -federate waits
+// for its hosts, for ssh to connect and rtgrep to start.
+const federateGrace = 5 * time.Second
+
+// readHosts reads the hosts of -federate from the file at path, one per
+// line, leaving out blank lines and those starting with #.
+func readHosts(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hosts []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts in %s", path)
+	}
+	return hosts, nil
+}
+
+// A hostConn is a connection to rtgrep rpc on a host.
+type hostConn interface {
+	io.ReadWriter
+
+	// Close ends the connection, and with it rtgrep rpc, and unblocks
+	// reads waiting on it.
+	Close() error
+}
+
+// sshConn is a hostConn to rtgrep rpc run by ssh.
+type sshConn struct {
+	cmd *exec.Cmd
+	io.WriteCloser
+	out io.ReadCloser
+}
+
+func (c *sshConn) Read(p []byte) (int, error) { return c.out.Read(p) }
+
+func (c *sshConn) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// dialSSH starts rtgrep rpc on host with ssh, which is killed once ctx is
+// done. ssh is not to ask for passwords, since the hosts are asked all at
+// once.
+func dialSSH(ctx context.Context, host string) (hostConn, error) {
+	// -- keeps a host from passing for an option of ssh.
+	cmd := exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", "--", host, "rtgrep", "rpc")
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd, in, out}, nil
+}
+
+// searchHosts runs r on the hosts listed in hostsFile, as -federate, and
+// calls found with each hit as it arrives. It returns the hits, sorted by
+// path, and the stats of the hosts added up. Hosts that fail are reported,
+// and counted as truncating the search; it fails only if all of them do.
+func searchHosts(hostsFile string, r *request, found func(hit)) ([]hit, stats, error) {
+	hosts, err := readHosts(hostsFile)
+	if err != nil {
+		return nil, stats{}, err
+	}
+	remote := *r
+	remote.Own = nil // paths here, not on the hosts
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout+federateGrace)
+	defer cancel()
+	var m []hit
+	results := federate(ctx, hosts, &remote, dialSSH, func(h hit) {
+		m = append(m, h)
+		found(h)
+	})
+	var st stats
+	failed := 0
+	for _, res := range results {
+		if res.err != nil {
+			log.Printf("%s: %v", res.host, res.err)
+			failed++
+			continue
+		}
+		st.add(res.st)
+	}
+	if failed == len(hosts) {
+		return nil, stats{}, errors.New("no host answered")
+	}
+	if failed > 0 && st.Truncated == "" {
+		st.Truncated = "failed hosts"
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].Path < m[j].Path })
+	return m, st, nil
+}
+
+// A hostResult is how a search went on one host of -federate.
+type hostResult struct {
+	host string
+	st   stats
+	err  error
+}
+
+// federate runs r on all hosts at once, connecting to them with dial, and
+// calls found with each hit as it arrives, its path prefixed with its
+// host. found is called by one host at a time. Hosts that have not
+// answered once ctx is done are cut off.
+func federate(ctx context.Context, hosts []string, r *request, dial func(ctx context.Context, host string) (hostConn, error), found func(hit)) []hostResult {
+	results := make([]hostResult, len(hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			st, err := searchHost(ctx, host, r, dial, func(h hit) {
+				h.Path = host + ":" + h.Path
+				mu.Lock()
+				defer mu.Unlock()
+				found(h)
+			})
+			results[i] = hostResult{host, st, err}
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// searchHost runs r by rtgrep rpc on host, and calls found with each hit.
+func searchHost(ctx context.Context, host string, r *request, dial func(ctx context.Context, host string) (hostConn, error), found func(hit)) (stats, error) {
+	conn, err := dial(ctx, host)
+	if err != nil {
+		return stats{}, err
+	}
+	var once sync.Once
+	hangUp := func() { once.Do(func() { conn.Close() }) }
+	defer hangUp()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hangUp()
+		case <-done:
+		}
+	}()
+
+	if err := json.NewEncoder(conn).Encode(&rpcMessage{Version: "2.0", ID: json.RawMessage("1"), Method: "search", Params: r}); err != nil {
+		return stats{}, hostErr(ctx, err)
+	}
+	dec := json.NewDecoder(conn)
+	for {
+		var m struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result *stats          `json:"result"`
+			Error  *rpcError       `json:"error"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			return stats{}, hostErr(ctx, err)
+		}
+		switch {
+		case m.Method == "hit":
+			var h rpcHit
+			if err := json.Unmarshal(m.Params, &h); err != nil {
+				return stats{}, err
+			}
+			found(h.hit)
+		case m.Method != "":
+			// Progress.
+		case m.Error != nil:
+			return stats{}, errors.New(m.Error.Message)
+		case m.Result != nil:
+			return *m.Result, nil
+		}
+	}
+}
+
+// hostErr returns the error to report for a host whose connection failed
+// with err.
+func hostErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errors.New("no answer before the deadline")
+	}
+	if err == io.EOF {
+		return errors.New("rtgrep rpc ended without an answer")
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// aliases maps a flag's name to the other names it can be given by, so that
+// grep and ripgrep spellings (-g, --glob, -i, --ignore-case...) work too.
+var aliases = map[string][]string{}
+
+// alias makes each of names an alternative spelling of the flag name, which
+// must already be defined. flag itself accepts -name and --name alike.
+func alias(name string, names ...string) {
+	f := flag.Lookup(name)
+	for _, n := range names {
+		flag.Var(f.Value, n, f.Usage)
+	}
+	aliases[name] = append(aliases[name], names...)
+}
+
+// isAlias reports whether name is an alternative spelling of another flag.
+func isAlias(name string) bool {
+	for _, names := range aliases {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// printFlags is flag.PrintDefaults, except that each flag is listed once
+// together with its aliases, short ones first.
+func printFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if isAlias(f.Name) {
+			return
+		}
+		var short, long []string
+		for _, n := range append([]string{f.Name}, aliases[f.Name]...) {
+			switch {
+			case len(n) == 1:
+				short = append(short, "-"+n)
+			case n == f.Name:
+				long = append(long, "-"+n)
+			default:
+				long = append(long, "--"+n)
+			}
+		}
+		names := append(short, long...)
+		s := "  " + strings.Join(names, ", ")
+		typ, usage := flag.UnquoteUsage(f)
+		if typ != "" {
+			s += " " + typ
+		}
+		s += "\n    \t" + strings.ReplaceAll(usage, "\n", "\n    \t")
+		switch {
+		case f.DefValue == "" || f.DefValue == "false" || f.DefValue == "0" || f.DefValue == "0s":
+		case typ == "string":
+			s += fmt.Sprintf(" (default %q)", f.DefValue)
+		default:
+			s += fmt.Sprintf(" (default %v)", f.DefValue)
+		}
+		fmt.Fprintln(flag.CommandLine.Output(), s)
+	})
+}
+
+// expandShort splits grouped single-letter boolean flags of fs, as in -in,
+// into -i -n before they reach fs.Parse. Arguments are left alone from the
+// first non-flag argument or "--" on, as fs.Parse would. A flag named like
+// a group, as -in would be, shadows the group, so none is to be named so.
+func expandShort(fs *flag.FlagSet, args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		if f := fs.Lookup(name); f != nil {
+			out = append(out, arg)
+			if !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				out = append(out, args[i])
+			}
+			continue
+		}
+		if arg[1] != '-' && !strings.Contains(name, "=") && shortBools(fs, name) {
+			for _, c := range name {
+				out = append(out, "-"+string(c))
+			}
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// shortBools reports whether every letter of s is a single-letter boolean
+// flag of fs.
+func shortBools(fs *flag.FlagSet, s string) bool {
+	for _, c := range s {
+		f := fs.Lookup(string(c))
+		if f == nil || !isBoolFlag(f) {
+			return false
+		}
+	}
+	return true
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// rgConfigArgs returns the options in ripgrep's config file, named by
+// $RIPGREP_CONFIG_PATH: one argument per line, with blank lines and lines
+// starting with # skipped. Options rtgrep does not have are dropped with a
+// warning, as is the next line if it looks like their value.
+func rgConfigArgs() ([]string, error) {
+	config := os.Getenv("RIPGREP_CONFIG_PATH")
+	if config == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, l := range bytes.Split(data, []byte{'\n'}) {
+		l = bytes.TrimSpace(l)
+		if len(l) > 0 && l[0] != '#' {
+			lines = append(lines, string(l))
+		}
+	}
+	var args []string
+	for i := 0; i < len(lines); i++ {
+		arg := lines[i]
+		name, value := strings.TrimLeft(arg, "-"), ""
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		}
+		f := flag.Lookup(name)
+		switch {
+		case arg[0] != '-':
+			args = append(args, arg)
+			continue
+		case f == nil:
+			log.Printf("%s: ignoring unsupported option %s", config, arg)
+		case f.Value == flag.Lookup("filepattern").Value && strings.HasPrefix(value, "!"):
+			// rtgrep cannot exclude by file name; a negated glob
+			// would match no file at all.
+			log.Printf("%s: ignoring negated glob %s", config, arg)
+		default:
+			args = append(args, arg)
+			continue
+		}
+		if value == "" && i+1 < len(lines) && lines[i+1][0] != '-' {
+			i++
+		}
+	}
+	return args, nil
+}
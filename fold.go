@@ -0,0 +1,126 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// With -i, letters match whatever Unicode simple case folding makes them
+// equal to: Cyrillic, Greek and the like as well as ASCII, and the Kelvin
+// sign K as k, but never one letter as two, so ß does not match ss. Folding
+// may change a letter's length in UTF-8, so a match need not be as long as
+// the pattern.
+
+// asciiKeys are the fold keys of the ASCII characters.
+var asciiKeys [utf8.RuneSelf]rune
+
+func init() {
+	for c := range asciiKeys {
+		asciiKeys[c] = slowFoldKey(rune(c))
+	}
+}
+
+// foldKey returns the rune that stands for r and every rune r folds to: the
+// smallest of them.
+func foldKey(r rune) rune {
+	if 0 <= r && r < utf8.RuneSelf {
+		return asciiKeys[r]
+	}
+	return slowFoldKey(r)
+}
+
+func slowFoldKey(r rune) rune {
+	k := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < k {
+			k = f
+		}
+	}
+	return k
+}
+
+// decodeFold returns the fold key of the rune at the start of b, which is
+// not empty, and its length. A byte that does not start valid UTF-8 stands
+// for itself only, with a key no rune has.
+func decodeFold(b []byte) (rune, int) {
+	if c := b[0]; c < utf8.RuneSelf {
+		return asciiKeys[c], 1
+	}
+	r, size := utf8.DecodeRune(b)
+	if r == utf8.RuneError && size == 1 {
+		return -1 - rune(b[0]), 1
+	}
+	return foldKey(r), size
+}
+
+// foldKeys returns the fold keys of the runes of pattern, for indexFold.
+func foldKeys(pattern []byte) []rune {
+	var keys []rune
+	for len(pattern) > 0 {
+		k, size := decodeFold(pattern)
+		keys = append(keys, k)
+		pattern = pattern[size:]
+	}
+	return keys
+}
+
+// indexFold returns the start and end of the first text in data equal to
+// the pattern with fold keys needle under simple case folding, or -1, -1 if
+// there is none.
+func indexFold(data []byte, needle []rune) (int, int) {
+	if len(needle) == 0 {
+		return 0, 0
+	}
+	for i := 0; i < len(data); {
+		k, size := decodeFold(data[i:])
+		if k == needle[0] {
+			if j, ok := hasPrefixFold(data[i+size:], needle[1:]); ok {
+				return i, i + size + j
+			}
+		}
+		i += size
+	}
+	return -1, -1
+}
+
+// hasPrefixFold reports whether data starts with the runes of needle under
+// simple case folding, and if so how many bytes of data they take.
+func hasPrefixFold(data []byte, needle []rune) (int, bool) {
+	n := 0
+	for _, want := range needle {
+		if n == len(data) {
+			return 0, false
+		}
+		k, size := decodeFold(data[n:])
+		if k != want {
+			return 0, false
+		}
+		n += size
+	}
+	return n, true
+}
+
+// asciiFoldSafe reports whether folding ASCII letters alone finds every
+// match of pattern in data: when both are ASCII, or when pattern is ASCII
+// without k or s, the only ASCII letters with a fold outside ASCII.
+func asciiFoldSafe(pattern, data []byte) bool {
+	if !isASCII(pattern) {
+		return false
+	}
+	for _, c := range pattern {
+		switch c {
+		case 'k', 'K', 's', 'S':
+			return isASCII(data)
+		}
+	}
+	return true
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
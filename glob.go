@@ -0,0 +1,123 @@
+//
+// Copyright Noel Cower 2014.
+//
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE_1_0.txt or copy at
+//  http://www.boost.org/LICENSE_1_0.txt)
+//
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// The glob matcher here started as github.com/nilium/glob, once vendored,
+// with its backtracking and escapes fixed. rtgrep matches paths with the
+// regular expressions of globRegexp; the matcher tells which patterns are
+// valid, and is what the tests hold those expressions to.
+
+var (
+	errGlobSequence = errors.New("* or ? may not follow *")
+	errGlobEscape   = errors.New("glob pattern ends in an unescaped backslash")
+)
+
+type globKind int
+
+const (
+	globMany globKind = iota
+	globOne
+	globString
+	globEnd
+)
+
+// A globStep is a wildcard, or the start of the pattern, and the literal
+// text following it.
+type globStep struct {
+	kind   globKind
+	substr string
+}
+
+// A globPattern is a compiled glob pattern.
+type globPattern struct {
+	steps []globStep
+}
+
+// newGlobPattern compiles pattern, in which * matches any run of bytes, ?
+// exactly one UTF-8 encoded rune, and a backslash the character after it,
+// even a backslash. A * may end anywhere, even inside a multi-byte rune, as
+// with path.Match; that only makes a difference where the pattern has
+// invalid UTF-8 after the *. A wildcard right after a *, and a backslash
+// ending the pattern, are errors. The pattern is scanned byte by byte, so
+// that literal text, invalid UTF-8 and all, is kept exactly as written.
+func newGlobPattern(pattern string) (*globPattern, error) {
+	steps := []globStep{{kind: globString}}
+	last := &steps[0]
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return nil, errGlobEscape
+			}
+			last.substr += pattern[i : i+1]
+		case '*', '?':
+			if last.kind == globMany && len(last.substr) == 0 {
+				return nil, errGlobSequence
+			}
+			kind := globOne
+			if c == '*' {
+				kind = globMany
+			}
+			steps = append(steps, globStep{kind: kind})
+			last = &steps[len(steps)-1]
+		default:
+			last.substr += pattern[i : i+1]
+		}
+	}
+	return &globPattern{append(steps, globStep{kind: globEnd})}, nil
+}
+
+// matches reports whether p matches str.
+//
+// Only the most recent * is ever backtracked into: once the text following a
+// * has been found, any later mismatch can be resolved by letting that *, and
+// not an earlier one, take more input, and matching takes at most about
+// len(str) steps per step of p.
+func (p *globPattern) matches(str string) bool {
+	i := 0
+	lastMany, lastManyStr := -1, ""
+	for {
+		step := p.steps[i]
+		switch step.kind {
+		case globMany:
+			lastMany, lastManyStr = i, str
+			fallthrough
+		case globString:
+			if strings.HasPrefix(str, step.substr) {
+				str = str[len(step.substr):]
+				i++
+				continue
+			}
+		case globOne:
+			_, size := utf8.DecodeRuneInString(str)
+			if size > 0 && strings.HasPrefix(str[size:], step.substr) {
+				str = str[size+len(step.substr):]
+				i++
+				continue
+			}
+		case globEnd:
+			if len(str) == 0 {
+				return true
+			}
+		}
+
+		// Mismatch: retry from the last * with it taking one more byte.
+		if lastMany == -1 || len(lastManyStr) == 0 {
+			return false
+		}
+		i, str = lastMany, lastManyStr[1:]
+	}
+}
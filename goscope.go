@@ -0,0 +1,99 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"time"
+)
+
+// goScopes are the values -go-scope accepts: function bodies, import
+// declarations and struct field tags.
+var goScopes = map[string]bool{
+	"func":       true,
+	"import":     true,
+	"struct-tag": true,
+}
+
+const (
+	// maxGoParseSize is the largest Go file -go-scope parses; larger
+	// files are matched as plain text.
+	maxGoParseSize = 1 << 20
+	// goParseTimeout bounds the time spent parsing one file.
+	goParseTimeout = 200 * time.Millisecond
+)
+
+// goScopeRanges parses data as Go source and returns the byte ranges of
+// the constructs selected by scope. ok is false if the file is too large,
+// does not parse or takes longer than goParseTimeout on clk to parse, in
+// which case the caller should treat it as plain text.
+func goScopeRanges(name string, data []byte, scope string, clk clock) (ranges [][2]int, ok bool) {
+	if len(data) > maxGoParseSize {
+		return nil, false
+	}
+	type parsed struct {
+		f   *ast.File
+		err error
+	}
+	fset := token.NewFileSet()
+	// done is buffered so that a parse that times out can still finish
+	// and exit; its result is dropped.
+	done := make(chan parsed, 1)
+	go func() {
+		f, err := parser.ParseFile(fset, name, data, parser.SkipObjectResolution)
+		done <- parsed{f, err}
+	}()
+	timeout := make(chan struct{})
+	t := clk.AfterFunc(goParseTimeout, func() { close(timeout) })
+	var p parsed
+	select {
+	case p = <-done:
+		t.Stop()
+	case <-timeout:
+		return nil, false
+	}
+	if p.err != nil {
+		return nil, false
+	}
+
+	file := fset.File(p.f.Pos())
+	add := func(from, to token.Pos) {
+		ranges = append(ranges, [2]int{file.Offset(from), file.Offset(to)})
+	}
+	ast.Inspect(p.f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			if scope == "func" && n.Body != nil {
+				add(n.Body.Lbrace, n.Body.End())
+			}
+		case *ast.FuncLit:
+			if scope == "func" {
+				add(n.Body.Lbrace, n.Body.End())
+			}
+		case *ast.GenDecl:
+			if scope == "import" && n.Tok == token.IMPORT {
+				add(n.Pos(), n.End())
+			}
+		case *ast.StructType:
+			if scope == "struct-tag" {
+				for _, field := range n.Fields.List {
+					if field.Tag != nil {
+						add(field.Tag.Pos(), field.Tag.End())
+					}
+				}
+			}
+		}
+		return true
+	})
+	return ranges, true
+}
+
+// inRanges reports whether data[start:end] lies within one of ranges.
+func inRanges(ranges [][2]int, start, end int) bool {
+	for _, r := range ranges {
+		if r[0] <= start && end <= r[1] {
+			return true
+		}
+	}
+	return false
+}
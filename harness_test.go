@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// This file tests search's pipeline against fs.FS fixtures instead of the
+// disk, so that failures, slow reads and deadlines happen exactly when a
+// test wants them to.
+
+// walkFS is the walker listing fsys.
+func walkFS(fsys fs.FS) walker {
+	return func(root string, fn walkFunc) error {
+		return fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fn(path, nil, err)
+			}
+			info, err := d.Info()
+			if err != nil {
+				return fn(path, nil, err)
+			}
+			return fn(path, info, nil)
+		})
+	}
+}
+
+// faultFS is an fs.FS that fails to open the files and directories in
+// errs, and calls onRead, if set, before opening anything else that is not
+// a directory.
+type faultFS struct {
+	files  fstest.MapFS
+	errs   map[string]error
+	onRead func(name string)
+}
+
+func (f *faultFS) Open(name string) (fs.File, error) {
+	if err := f.errs[name]; err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if f.onRead != nil {
+		if info, err := fs.Stat(f.files, name); err == nil && !info.IsDir() {
+			f.onRead(name)
+		}
+	}
+	return f.files.Open(name)
+}
+
+// searchFS runs q on fsys, with the time taken from clk if it is set.
+func searchFS(ctx context.Context, fsys fs.FS, q *query, clk clock) ([]hit, stats, error) {
+	read := func(path string) ([]byte, error) { return fs.ReadFile(fsys, path) }
+	p := newPipeline(q, walkFS(fsys), read)
+	p.open = func(path string) (io.ReadCloser, error) { return fsys.Open(path) }
+	if clk != nil {
+		p.clock = clk
+	}
+	return p.run(ctx, []string{"."})
+}
+
+func file(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+func paths(m []hit) []string {
+	var p []string
+	for _, h := range m {
+		p = append(p, h.Path)
+	}
+	return p
+}
+
+func TestPipelineWalk(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":       file("needle"),
+		"b.log":       file("needle"),
+		"big.txt":     file("needle, and a lot more"),
+		"link.txt":    &fstest.MapFile{Data: []byte("a.txt"), Mode: fs.ModeSymlink},
+		"dir/c.txt":   file("needle"),
+		"dir/d.txt":   file("needle"),
+		"dir/e/f.txt": file("needle"),
+	}
+	q := &query{pattern: "needle", filepattern: "*.txt", maxMem: 10, maxFiles: 3}
+	p := newPipeline(q, walkFS(fsys), nil)
+	c := make(chan candidate, 10)
+	if err := p.walk(context.Background(), []string{"."}, c); err != nil {
+		t.Fatal(err)
+	}
+	close(c)
+	var got []string
+	for cand := range c {
+		got = append(got, cand.path)
+	}
+	if want := []string{"a.txt", "dir/c.txt", "dir/d.txt"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+	// The walk stops at dir/e/f.txt, the first file past -max-files,
+	// before link.txt.
+	st := p.st
+	if st.Walked != 6 || st.Ignored != 1 || st.Special != 0 || st.TooLarge != 1 || !st.FilesLeft || st.LastPath != "dir/e/f.txt" {
+		t.Errorf("got %d walked, %d ignored, %d special, %d too large, files left %v, last %s; want 6, 1, 0, 1, true, dir/e/f.txt",
+			st.Walked, st.Ignored, st.Special, st.TooLarge, st.FilesLeft, st.LastPath)
+	}
+
+	p = newPipeline(&query{pattern: "needle", filepattern: "*"}, walkFS(fsys), nil)
+	c = make(chan candidate, 10)
+	if err := p.walk(context.Background(), []string{"."}, c); err != nil {
+		t.Fatal(err)
+	}
+	if p.st.Special != 1 {
+		t.Errorf("got %d special, want link.txt", p.st.Special)
+	}
+
+	// -max-bytes stops the walk at the file that would go past it:
+	// a.txt and b.log fit in 12 bytes, but not big.txt after them.
+	p = newPipeline(&query{pattern: "needle", filepattern: "*", maxBytes: 12}, walkFS(fsys), nil)
+	c = make(chan candidate, 10)
+	if err := p.walk(context.Background(), []string{"."}, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 || !p.st.FilesLeft || p.st.Truncated != "max-bytes" || p.st.LastPath != "big.txt" {
+		t.Errorf("-max-bytes 12: got %d candidates, files left %v, truncated %q, last %s; want 2, true, max-bytes, big.txt",
+			len(c), p.st.FilesLeft, p.st.Truncated, p.st.LastPath)
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	fsys := fstest.MapFS{}
+	var want []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("d%d/f%02d.txt", i%7, i)
+		fsys[name] = file("needle")
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	m, st, err := searchFS(context.Background(), fsys, &query{pattern: "needle", filepattern: "*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths(m)) != fmt.Sprint(want) {
+		t.Errorf("got hits %v, want %v", paths(m), want)
+	}
+	if st.Searched != 50 || st.Matched != 50 || st.Truncated != "" {
+		t.Errorf("got %d searched, %d matched, truncated %q; want 50, 50, none", st.Searched, st.Matched, st.Truncated)
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	ctx, cancel := clk.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fsys := &faultFS{files: fstest.MapFS{
+		"a.txt": file("needle"),
+		"b.txt": file("needle"),
+		"c.txt": file("needle"),
+	}}
+	// Everything but a.txt is still being read when the deadline passes,
+	// which is once a.txt's hit is in.
+	fsys.onRead = func(name string) {
+		if name != "a.txt" {
+			<-ctx.Done()
+		}
+	}
+	q := &query{pattern: "needle", filepattern: "*", onHit: func(hit) { clk.advance(10 * time.Second) }}
+	m, st, err := searchFS(ctx, fsys, q, clk)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if got := paths(m); len(got) != 1 || got[0] != "a.txt" {
+		t.Errorf("got hits %v, want [a.txt]", got)
+	}
+	if st.Truncated != "timeout" || st.Duration != 10*time.Second {
+		t.Errorf("got truncated %q after %v, want timeout after 10s", st.Truncated, st.Duration)
+	}
+}
+
+func TestPipelineUntilStable(t *testing.T) {
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	fsys := &faultFS{files: fstest.MapFS{
+		"a.txt": file("needle"),
+		"b.txt": file("needle"),
+	}}
+	// b.txt is still being read when the quiet time after a.txt's hit is
+	// up.
+	quiet := make(chan struct{})
+	fsys.onRead = func(name string) {
+		if name != "a.txt" {
+			<-quiet
+		}
+	}
+	q := &query{pattern: "needle", filepattern: "*", untilStable: time.Second}
+	q.onHit = func(hit) {
+		clk.advance(time.Second)
+		close(quiet)
+	}
+	m, st, err := searchFS(context.Background(), fsys, q, clk)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if got := paths(m); len(got) != 1 || got[0] != "a.txt" {
+		t.Errorf("got hits %v, want [a.txt]", got)
+	}
+	if st.Truncated != "until-stable" {
+		t.Errorf("got truncated %q, want until-stable", st.Truncated)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fsys := &faultFS{files: fstest.MapFS{
+		"a.txt": file("needle"),
+		"b.txt": file("needle"),
+		"c.txt": file("needle"),
+	}}
+	// Cancel once every file is being read, and hold the readers until
+	// then.
+	var started, reading int32
+	fsys.onRead = func(name string) {
+		atomic.AddInt32(&reading, 1)
+		if atomic.AddInt32(&started, 1) == 3 {
+			cancel()
+		}
+		<-ctx.Done()
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&reading, -1)
+	}
+	m, _, err := searchFS(ctx, fsys, &query{pattern: "needle", filepattern: "*"}, nil)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(m) != 0 {
+		t.Errorf("got hits %v after cancelation, want none", paths(m))
+	}
+	if n := atomic.LoadInt32(&reading); n != 0 {
+		t.Errorf("search returned with %d readers still running", n)
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	fsys := &faultFS{
+		files: fstest.MapFS{
+			"ok.txt":         file("needle"),
+			"secret.txt":     file("needle"),
+			"gone.txt":       file("needle"),
+			"locked/x.txt":   file("needle"),
+			"moved/away.txt": file("needle"),
+		},
+		errs: map[string]error{
+			"secret.txt": fs.ErrPermission,
+			"gone.txt":   fs.ErrNotExist,
+			"locked":     fs.ErrPermission,
+			"moved":      fs.ErrNotExist,
+		},
+	}
+	m, st, err := searchFS(context.Background(), fsys, &query{pattern: "needle", filepattern: "*"}, nil)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if got := paths(m); len(got) != 1 || got[0] != "ok.txt" {
+		t.Errorf("got hits %v, want [ok.txt]", got)
+	}
+	if st.Denied != 2 || st.Vanished != 2 {
+		t.Errorf("got %d denied, %d vanished; want 2, 2", st.Denied, st.Vanished)
+	}
+
+	// Any other error stops the search.
+	eio := errors.New("input/output error")
+	fsys.errs["ok.txt"] = eio
+	if _, _, err := searchFS(context.Background(), fsys, &query{pattern: "needle", filepattern: "*"}, nil); !errors.Is(err, eio) {
+		t.Errorf("got error %v, want %v", err, eio)
+	}
+}
+
+func TestPipelineRetries(t *testing.T) {
+	fsys := fstest.MapFS{
+		"flaky.txt":  file("needle"),
+		"broken.txt": file("needle"),
+		"ok.txt":     file("needle"),
+	}
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	var mu sync.Mutex
+	reads := make(map[string][]time.Duration) // since the start, by path
+	read := func(path string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reads[path] = append(reads[path], clk.Now().Sub(time.Unix(1e9, 0)))
+		switch {
+		case path == "flaky.txt" && len(reads[path]) == 1:
+			return nil, &fs.PathError{Op: "read", Path: path, Err: syscall.EIO}
+		case path == "broken.txt":
+			return nil, &fs.PathError{Op: "read", Path: path, Err: syscall.ETIMEDOUT}
+		}
+		return fs.ReadFile(fsys, path)
+	}
+	search := func(q *query) ([]hit, stats) {
+		p := newPipeline(q, walkFS(fsys), read)
+		p.clock = clk
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+					clk.advance(10 * time.Millisecond)
+				}
+			}
+		}()
+		m, st, err := p.run(context.Background(), []string{"."})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m, st
+	}
+
+	m, st := search(&query{pattern: "needle", filepattern: "*", retries: 2, retryBackoff: 100 * time.Millisecond})
+	if got := fmt.Sprint(paths(m)); got != "[flaky.txt ok.txt]" {
+		t.Errorf("got hits %s, want [flaky.txt ok.txt]", got)
+	}
+	if st.Retried != 3 || st.IOErrors != 1 {
+		t.Errorf("got %d retried, %d I/O errors; want 3, 1", st.Retried, st.IOErrors)
+	}
+	// broken.txt is tried three times, backing off 100ms and then 200ms.
+	if r := reads["broken.txt"]; len(r) != 3 || r[1]-r[0] < 100*time.Millisecond || r[2]-r[1] < 200*time.Millisecond {
+		t.Errorf("broken.txt read at %v, want three reads 100ms and then 200ms apart", r)
+	}
+
+	// Without retries, transient errors are counted rather than retried.
+	reads = make(map[string][]time.Duration)
+	m, st = search(&query{pattern: "needle", filepattern: "*"})
+	if got := fmt.Sprint(paths(m)); got != "[ok.txt]" {
+		t.Errorf("without retries: got hits %s, want [ok.txt]", got)
+	}
+	if st.Retried != 0 || st.IOErrors != 2 {
+		t.Errorf("without retries: got %d retried, %d I/O errors; want 0, 2", st.Retried, st.IOErrors)
+	}
+}
+
+func TestPipelineChanged(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":       file("needle"),
+		"growing.txt": file("needle"),
+		"other.log":   file("nothing"),
+	}
+	read := func(path string) ([]byte, error) {
+		data, err := fs.ReadFile(fsys, path)
+		if err == nil && path != "a.txt" {
+			err = errChanged
+		}
+		return data, err
+	}
+	m, st, err := newPipeline(&query{pattern: "needle", filepattern: "*"}, walkFS(fsys), read).run(context.Background(), []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0].Changed || !m[1].Changed {
+		t.Errorf("got hits %+v, want a.txt and growing.txt, changed", m)
+	}
+	if st.Changed != 2 || st.Searched != 3 {
+		t.Errorf("got %d changed, %d searched; want 2, 3", st.Changed, st.Searched)
+	}
+	// A trace replays the change.
+	if err := newTraceError(errChanged).err(); err != errChanged {
+		t.Errorf("replayed %v, want errChanged", err)
+	}
+}
+
+func TestPipelineCompatRg(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitignore":          file("*.log\nbuild/\n/top.txt\n!keep.log\n"),
+		"a.txt":               file("needle"),
+		"top.txt":             file("needle"),
+		"x.log":               file("needle"),
+		"keep.log":            file("needle"),
+		".hidden.txt":         file("needle"),
+		".git/config":         file("needle"),
+		"build/out.txt":       file("needle"),
+		"sub/top.txt":         file("needle"),
+		"sub/build/deep.txt":  file("needle"),
+		"sub/.ignore":         file("*.txt\n!b.txt\n"),
+		"sub/a.txt":           file("needle"),
+		"sub/b.txt":           file("needle"),
+		"sub/c/.rgignore":     file("!a.txt\n"),
+		"sub/c/a.txt":         file("needle"),
+		"vendor/**/lib/x.txt": file("needle"),
+	}
+	q := &query{pattern: "needle", filepattern: "*", compat: "rg"}
+	m, st, err := searchFS(context.Background(), fsys, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.txt", "keep.log", "sub/b.txt", "sub/c/a.txt", "vendor/**/lib/x.txt"}
+	if fmt.Sprint(paths(m)) != fmt.Sprint(want) {
+		t.Errorf("got hits %v, want %v", paths(m), want)
+	}
+	// .git, build and sub/build count once each, and are not walked.
+	if st.Ignored != 11 || st.Walked != 13 {
+		t.Errorf("got %d ignored of %d walked, want 11 of 13", st.Ignored, st.Walked)
+	}
+}
+
+func TestPipelineBinaryFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt": file("a needle\n"),
+		"b.bin": file("\x00\x01needle\n"),
+		"c.bin": file("\x00\x01nothing\n"),
+		// NULs past the start do not make a file binary.
+		"late.txt": file(strings.Repeat("x\n", binarySample) + "needle\n\x00"),
+	}
+	for _, tc := range []struct {
+		binaryFiles string
+		want        string
+		binary      int
+	}{
+		{"", "[a.txt b.bin(binary) late.txt]", 0},
+		{"without-match", "[a.txt late.txt]", 2},
+		{"text", "[a.txt b.bin late.txt]", 0},
+	} {
+		q := &query{pattern: "needle", filepattern: "*", lineNumbers: true, binaryFiles: tc.binaryFiles}
+		m, st, err := searchFS(context.Background(), fsys, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range m {
+			switch {
+			case h.Binary && h.Lines == nil:
+				got = append(got, h.Path+"(binary)")
+			case !h.Binary && len(h.Lines) == 1:
+				got = append(got, h.Path)
+			default:
+				t.Errorf("-binary-files %q: hit %+v", tc.binaryFiles, h)
+			}
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Errorf("-binary-files %q: got %v, want %s", tc.binaryFiles, got, tc.want)
+		}
+		if st.Binary != tc.binary {
+			t.Errorf("-binary-files %q: got %d binary, want %d", tc.binaryFiles, st.Binary, tc.binary)
+		}
+	}
+
+	// Records delimited by NULs are text, with the default -binary-files.
+	r := &request{Pattern: "needle", FilePattern: "*.nul", LineNumbers: true, RecordDelim: "nul"}
+	q, err := r.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, st, err := searchFS(context.Background(), fstest.MapFS{"r.nul": file("hay\x00a needle\x00hay\x00")}, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Binary || len(m[0].Lines) != 1 || m[0].Lines[0].N != 2 || m[0].Lines[0].Text != "a needle" || st.Binary != 0 {
+		t.Errorf("-record-delim nul: got hits %+v, want record 2, a needle", m)
+	}
+}
+
+func TestPipelineHash(t *testing.T) {
+	fsys := fstest.MapFS{"a.txt": file("a needle\n"), "b.txt": file("hay\n")}
+	for _, tc := range []struct {
+		hash, sum string
+	}{
+		{"md5", "6e49b539713ebfc1b71eeba31610df4b"},
+		{"sha256", "e490f4e0df1aa85789ba866a7def975f7bb8f0993f091a361c76d885fda6a868"},
+	} {
+		q, err := (&request{Pattern: "needle", FilePattern: "*", Hash: tc.hash}).query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, _, err := searchFS(context.Background(), fsys, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 1 || m[0].Sum != tc.sum || m[0].Hash != tc.hash {
+			t.Fatalf("-hash %s: got hits %+v, want a.txt with sum %s", tc.hash, m, tc.sum)
+		}
+		b, _ := json.Marshal(m[0])
+		if want := `{"path":"a.txt","sum":"` + tc.sum + `","hash":"` + tc.hash + `"}`; string(b) != want {
+			t.Errorf("-hash %s: hit encoded as %s, want %s", tc.hash, b, want)
+		}
+		var text bytes.Buffer
+		(&textSink{w: nopCloser{&text}}).finish(m, stats{Matched: 1})
+		if want := tc.sum + "  a.txt\n1 hits\n"; text.String() != want {
+			t.Errorf("-hash %s: text sink wrote %q, want %q", tc.hash, text.String(), want)
+		}
+	}
+	if _, err := (&request{Pattern: "needle", Hash: "crc32"}).query(); err == nil {
+		t.Errorf("-hash crc32 succeeded")
+	}
+}
+
+func TestPipelineReadProfile(t *testing.T) {
+	var log, long strings.Builder
+	for i := 1; i <= 3000; i++ {
+		if i%1000 == 0 {
+			fmt.Fprintf(&log, "line %d, a needle\n", i)
+		} else {
+			fmt.Fprintf(&log, "line %d\n", i)
+		}
+	}
+	long.WriteString("short\n")
+	long.WriteString(strings.Repeat("x", 20000))
+	long.WriteString("needle\nlast needle")
+	fsys := fstest.MapFS{
+		"a.go":     file("package a // needle\n"),
+		"big.log":  file(log.String()),
+		"long.log": file(long.String()),
+		"none.log": file(strings.Repeat("hay\n", 5000)),
+	}
+	var size int64
+	for _, f := range fsys {
+		size += int64(len(f.Data))
+	}
+	chunked := []readProfile{{exts: []string{".log"}, chunk: minChunk}}
+
+	// Chunks give the hits reading whole files does.
+	for _, q := range []query{
+		{lineNumbers: true},
+		{lineNumbers: true, ignoreCase: true},
+		{hash: "sha256"},
+		{lineNumbers: true, hash: "md5", maxLine: 20},
+	} {
+		q.pattern, q.filepattern = "needle", "*"
+		whole, _, err := searchFS(context.Background(), fsys, &q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.profiles = chunked
+		m, st, err := searchFS(context.Background(), fsys, &q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, whole) {
+			t.Errorf("%+v: read in chunks, got %+v, want %+v", q, m, whole)
+		}
+		if st.BytesRead != size {
+			t.Errorf("%+v: read %d bytes, want all %d", q, st.BytesRead, size)
+		}
+	}
+
+	// Only the files with matches asked for, reading stops at the first.
+	q := &query{pattern: "needle", filepattern: "*", profiles: chunked}
+	m, st, err := searchFS(context.Background(), fsys, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(m), []string{"a.go", "big.log", "long.log"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got hits %q, want %q", got, want)
+	}
+	if st.BytesRead >= size {
+		t.Errorf("read %d bytes of %d, want reading to stop at the first match", st.BytesRead, size)
+	}
+
+	// Files larger than -max-mem are searched in chunks that fit.
+	for _, profiles := range [][]readProfile{nil, chunked} {
+		q := &query{pattern: "needle", filepattern: "*.log", maxMem: minChunk + 1, profiles: profiles}
+		m, st, err := searchFS(context.Background(), fsys, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profiles == nil && (len(m) != 0 || st.TooLarge != 3) {
+			t.Errorf("read whole, got %d hits and %d too large, want 0 and 3", len(m), st.TooLarge)
+		}
+		if profiles != nil && (len(m) != 2 || st.TooLarge != 0) {
+			t.Errorf("read in chunks, got %d hits and %d too large, want 2 and 0", len(m), st.TooLarge)
+		}
+	}
+}
+
+func TestPipelineReadProfileReaders(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 0; i < 20; i++ {
+		fsys[fmt.Sprintf("%d.log", i)] = file("needle")
+		fsys[fmt.Sprintf("%d.go", i)] = file("needle")
+	}
+	var mu sync.Mutex
+	logs, most := 0, 0
+	read := func(path string) ([]byte, error) {
+		if strings.HasSuffix(path, ".log") {
+			mu.Lock()
+			logs++
+			if logs > most {
+				most = logs
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			logs--
+			mu.Unlock()
+		}
+		return fs.ReadFile(fsys, path)
+	}
+	q := &query{pattern: "needle", filepattern: "*", profiles: []readProfile{{exts: []string{".log"}, readers: 1}}}
+	m, _, err := newPipeline(q, walkFS(fsys), read).run(context.Background(), []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 40 {
+		t.Errorf("got %d hits, want 40", len(m))
+	}
+	if most != 1 {
+		t.Errorf("read up to %d .log files at once, want 1", most)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	fsys := &faultFS{
+		files: fstest.MapFS{
+			"a.txt":   file("needle"),
+			"b.txt":   file("hay"),
+			"c/d.txt": file("hay\nneedle"),
+			"c/e.txt": file("needle"),
+			"f.txt":   file("needle"),
+			"g.txt":   file("needle"),
+			"h.txt":   file("needle"),
+			"i.txt":   file("needle"),
+		},
+		errs: map[string]error{"c/e.txt": fs.ErrPermission, "f.txt": fs.ErrNotExist},
+		// Every read takes 3s, so that the deadline comes after three
+		// or four of them, depending on the order they happen in.
+		onRead: func(string) { clk.advance(3 * time.Second) },
+	}
+	var trace bytes.Buffer
+	rec := newRecorder(&trace, &request{}, clk)
+	ctx, cancel := clk.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	read := func(path string) ([]byte, error) { return fs.ReadFile(fsys, path) }
+	p := newPipeline(&query{pattern: "needle", filepattern: "*", lineNumbers: true}, rec.walker(walkFS(fsys)), rec.readFile(read))
+	p.clock = clk
+	m, st, err := p.run(ctx, []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Truncated != "timeout" {
+		t.Fatalf("recorded search got truncated %q, want timeout", st.Truncated)
+	}
+	for i := 0; i < 5; i++ {
+		rp, err := readTrace(bytes.NewReader(trace.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := rp.clock.WithTimeout(context.Background(), 10*time.Second)
+		p := newPipeline(&query{pattern: "needle", filepattern: "*", lineNumbers: true}, rp.walk, rp.readFile)
+		p.clock = rp.clock
+		rm, rst, err := p.run(ctx, []string{"."})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(rm) != fmt.Sprint(m) {
+			t.Errorf("replay got hits %v, recorded %v", rm, m)
+		}
+		if rst != st {
+			t.Errorf("replay got stats %+v, recorded %+v", rst, st)
+		}
+	}
+}
+
+func TestTraceReplayErrors(t *testing.T) {
+	fsys := &faultFS{
+		files: fstest.MapFS{
+			"a.txt":      file("needle"),
+			"eio.txt":    file("needle"),
+			"deep/b.txt": file("needle"),
+		},
+		errs: map[string]error{"eio.txt": syscall.EIO, "deep": syscall.ENAMETOOLONG},
+	}
+	for _, tc := range []struct{ name, kind string }{
+		{"eio.txt", "transient"},
+		{"deep", "toolong"},
+	} {
+		if k := newTraceError(&fs.PathError{Op: "open", Path: tc.name, Err: fsys.errs[tc.name]}).Kind; k != tc.kind {
+			t.Errorf("%s: recorded kind %q, want %q", tc.name, k, tc.kind)
+		}
+	}
+
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	var trace bytes.Buffer
+	rec := newRecorder(&trace, &request{}, clk)
+	read := func(path string) ([]byte, error) { return fs.ReadFile(fsys, path) }
+	p := newPipeline(&query{pattern: "needle", filepattern: "*"}, rec.walker(walkFS(fsys)), rec.readFile(read))
+	p.clock = clk
+	m, st, err := p.run(context.Background(), []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if st.IOErrors != 1 || st.TooDeep != 1 {
+		t.Fatalf("recorded search got %d I/O errors, %d too deep; want 1, 1", st.IOErrors, st.TooDeep)
+	}
+
+	rp, err := readTrace(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = newPipeline(&query{pattern: "needle", filepattern: "*"}, rp.walk, rp.readFile)
+	p.clock = rp.clock
+	rm, rst, err := p.run(context.Background(), []string{"."})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if fmt.Sprint(rm) != fmt.Sprint(m) || rst.IOErrors != 1 || rst.TooDeep != 1 || rst.TooDeepPath != st.TooDeepPath {
+		t.Errorf("replay got hits %v, stats %+v; recorded %v, %+v", rm, rst, m, st)
+	}
+}
+
+func TestWalkCoverage(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/1.txt":   file("needle"),
+		"b/1.txt":   file("needle"),
+		"b/2.txt":   file("needle"),
+		"c/1.txt":   file("needle"),
+		"d.txt":     file("needle"),
+		"e/f/1.txt": file("needle"),
+	}
+	readDir := func(dir string) ([]os.FileInfo, error) {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		var list []os.FileInfo
+		for _, e := range entries {
+			info, _ := e.Info()
+			list = append(list, info)
+		}
+		return list, nil
+	}
+	clk := newVirtualClock(time.Unix(1e9, 0))
+	ctx, cancel := clk.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// The deadline passes as the walk reaches b/2.txt.
+	walk := func(root string, fn walkFunc) error {
+		return walkFS(fsys)(root, func(path string, info os.FileInfo, err error) error {
+			if path == "b/2.txt" {
+				clk.advance(time.Second)
+			}
+			return fn(path, info, err)
+		})
+	}
+	read := func(path string) ([]byte, error) { return fs.ReadFile(fsys, path) }
+	p := newPipeline(&query{pattern: "needle", filepattern: "*"}, walk, read)
+	p.clock = clk
+	_, st, err := p.run(ctx, []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Truncated != "timeout" || st.LastPath != "b/1.txt" {
+		t.Fatalf("got truncated %q after %q, want timeout after b/1.txt", st.Truncated, st.LastPath)
+	}
+	for _, tc := range []struct {
+		lastPath string
+		roots    []string
+		want     string
+	}{
+		{"b/1.txt", []string{"."}, "1 of 5"},
+		{"d.txt", []string{"."}, "4 of 5"},
+		{"e/f/1.txt", []string{"."}, "4 of 5"},
+		{"b/1.txt", []string{"a", "b", "c", "d.txt"}, "2 of 5"},
+		{"d.txt", []string{"a", "b", "d.txt", "e"}, "4 of 5"},
+		{"e/f/1.txt", []string{"a", "b", "d.txt", "e"}, "4 of 5"},
+	} {
+		st := stats{LastPath: tc.lastPath}
+		covered, total := st.coverage(tc.roots, readDir)
+		if got := fmt.Sprintf("%d of %d", covered, total); got != tc.want {
+			t.Errorf("stopped after %s in %v: got %s covered, want %s", tc.lastPath, tc.roots, got, tc.want)
+		}
+	}
+}
+
+func TestIgnoreRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "a/main.go", false},
+		{"**/testdata", "testdata", true},
+		{"**/testdata", "a/b/testdata", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a?c", "a/c", false},
+		{"[!a]bc", "xbc", true},
+		{"[!a]bc", "abc", false},
+		{`\!x`, "!x", true},
+	} {
+		re := regexp.MustCompile(ignoreRegexp(tc.pattern))
+		if got := re.MatchString(tc.path); got != tc.want {
+			t.Errorf("%q (%s) matching %q = %v, want %v", tc.pattern, re, tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyMax is how many searches the history keeps. The file is allowed to
+// grow to twice that before it is cut back.
+const historyMax = 100
+
+// A historyEntry is a search in the history.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Dir       string    `json:"dir"`   // the working directory
+	Flags     []string  `json:"flags"` // the flags given
+	Args      []string  `json:"args"`  // the pattern, if one was taken, and the roots
+	Hits      int       `json:"hits"`
+	Truncated string    `json:"truncated,omitempty"`
+}
+
+// historyPath returns the file the history is kept in, one JSON entry per
+// line, oldest first: $RTGREP_HISTORY. It is empty, and no history is
+// kept, unless that is set. The history is off by default as it holds
+// patterns as given, and those are often the tokens and secrets being
+// looked for; the file is made readable by its owner only.
+func historyPath() string {
+	return os.Getenv("RTGREP_HISTORY")
+}
+
+// readHistory returns the searches in the history file at path, oldest
+// first. A missing file is an empty history, and lines that are not
+// entries are skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var h []historyEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e historyEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			h = append(h, e)
+		}
+	}
+	return h, sc.Err()
+}
+
+// addHistory appends e to the history file at path, and cuts the file back
+// to the last historyMax entries once it holds twice as many.
+func addHistory(path string, e historyEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	h, err := readHistory(path)
+	if err != nil || len(h) < 2*historyMax {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range h[len(h)-historyMax:] {
+		enc.Encode(e)
+	}
+	tmp := path + ".tmp"
+	// WriteFile keeps the mode of a file that is there already.
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// recordHistory adds a search to the history, if it is on, with a warning
+// if that fails.
+func recordHistory(flags, args []string, hits int, truncated string) {
+	path := historyPath()
+	if path == "" {
+		return
+	}
+	dir, _ := os.Getwd()
+	if err := addHistory(path, historyEntry{time.Now(), dir, flags, args, hits, truncated}); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
+
+// command returns e's command line, quoted for a POSIX shell.
+func (e *historyEntry) command() string {
+	words := []string{"rtgrep"}
+	for _, a := range e.Flags {
+		words = append(words, shellQuote(a))
+	}
+	for _, a := range e.Args {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote returns s, quoted if a POSIX shell would not take it as one
+// word as it is.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./:,@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// printHistory writes the last n entries of h, most recent first, numbered
+// as rerun takes them: 1 is the most recent.
+func printHistory(w io.Writer, h []historyEntry, n int) {
+	for i := 1; i <= n && i <= len(h); i++ {
+		e := &h[len(h)-i]
+		result := fmt.Sprintf("%d hits", e.Hits)
+		if e.Truncated != "" {
+			result += fmt.Sprintf(" (%s)", e.Truncated)
+		}
+		fmt.Fprintf(w, "%4d  %s  %-20s  %s\n", i, e.Time.Format("2006-01-02 15:04"), result, e.command())
+		if e.Dir != "" {
+			fmt.Fprintf(w, "      in %s\n", e.Dir)
+		}
+	}
+}
+
+// history runs rtgrep history: it lists recent searches.
+func history(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	n := fs.Int("n", 20, "list this many of the most recent searches")
+	fs.Parse(args)
+	printHistory(os.Stdout, loadHistory(), *n)
+}
+
+// loadHistory returns the history for history and rerun, which cannot do
+// without it.
+func loadHistory() []historyEntry {
+	path := historyPath()
+	if path == "" {
+		log.Fatal("the history is off: set $RTGREP_HISTORY to the file to keep it in")
+	}
+	h, err := readHistory(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return h
+}
+
+// rerunArgs returns the command-line arguments, without the program name,
+// of rtgrep rerun [N] [flags]: those of the Nth most recent search, by
+// default the last, with flags added after its own, so that they override
+// them. It also returns the directory the search ran in.
+func rerunArgs(h []historyEntry, args []string) (dir string, out []string, err error) {
+	n := 1
+	if len(args) > 0 {
+		if i, err := strconv.Atoi(args[0]); err == nil {
+			n, args = i, args[1:]
+		}
+	}
+	if n < 1 || n > len(h) {
+		return "", nil, fmt.Errorf("no search %d in the history of %d", n, len(h))
+	}
+	e := h[len(h)-n]
+	flags := e.Flags
+	if len(flags) > 0 && flags[len(flags)-1] == "--" {
+		flags = flags[:len(flags)-1]
+	}
+	out = append(out, flags...)
+	out = append(out, args...)
+	out = append(out, "--")
+	return e.Dir, append(out, e.Args...), nil
+}
+
+// rerun sets up rtgrep rerun [N] [flags]: it prints the command line of
+// the search to repeat to stderr, changes to its directory, and returns
+// its arguments for main to run.
+func rerun(args []string) []string {
+	dir, out, err := rerunArgs(loadHistory(), args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, (&historyEntry{Args: out}).command())
+	if dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return out
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFiles are the files whose patterns -compat rg honors in each
+// directory, later ones taking precedence, as in ripgrep.
+var ignoreFiles = []string{".gitignore", ".ignore", ".rgignore"}
+
+// An ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+	re       *regexp.Regexp
+	negate   bool // a ! rule, re-including what earlier rules excluded
+	dirOnly  bool // a rule ending in /, matching directories only
+	anchored bool // a rule with a /, matching paths relative to its directory
+}
+
+// parseIgnore returns the rules in the ignore file data, in gitignore
+// syntax.
+func parseIgnore(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	for _, l := range bytes.Split(data, []byte{'\n'}) {
+		s := strings.TrimSuffix(string(l), "\r")
+		for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, `\ `) {
+			s = s[:len(s)-1]
+		}
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		var r ignoreRule
+		if s[0] == '!' {
+			r.negate, s = true, s[1:]
+		}
+		if strings.HasSuffix(s, "/") {
+			r.dirOnly, s = true, strings.TrimRight(s, "/")
+		}
+		if strings.Contains(s, "/") {
+			r.anchored, s = true, strings.TrimPrefix(s, "/")
+		}
+		if s == "" {
+			continue
+		}
+		re, err := regexp.Compile(ignoreRegexp(s))
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// ignoreRegexp returns the regular expression, anchored at both ends, for
+// the gitignore pattern p, in which * and ? do not match /, ** matches
+// across directories, and [...] is a character class.
+func ignoreRegexp(p string) string {
+	var b strings.Builder
+	b.WriteString(`^`)
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString(`(?:.*/)?`)
+			i += 2
+		case strings.HasPrefix(p[i:], "/**") && i+3 == len(p):
+			b.WriteString(`/.*`)
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(`.*`)
+			i++
+		case c == '*':
+			b.WriteString(`[^/]*`)
+		case c == '?':
+			b.WriteString(`[^/]`)
+		case c == '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString(`$`)
+	return b.String()
+}
+
+// An ignorer tells which paths below root the ignore files there exclude,
+// along with hidden files and directories, as ripgrep does by default. It
+// reads each directory's ignore files once, when first needed.
+type ignorer struct {
+	root     string
+	readFile func(path string) ([]byte, error)
+	rules    map[string][]ignoreRule // by directory below root: "" or "a/b/"
+	dirs     map[string]bool         // whether a directory, "a/b", is ignored
+}
+
+func newIgnorer(root string, readFile func(path string) ([]byte, error)) *ignorer {
+	return &ignorer{
+		root:     root,
+		readFile: readFile,
+		rules:    make(map[string][]ignoreRule),
+		dirs:     make(map[string]bool),
+	}
+}
+
+// ignored reports whether the file at path, found below ig's root, is to
+// be left out of the search. A file in an ignored directory is ignored
+// whatever the rules say about the file itself, as in git.
+func (ig *ignorer) ignored(p string) bool {
+	rel, err := filepath.Rel(ig.root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if dir := path.Dir(rel); dir != "." && ig.dirIgnored(dir) {
+		return true
+	}
+	return ig.match(rel, false)
+}
+
+// ignoredDir reports whether the directory at path, found below ig's root,
+// is to be left out of the search, and with it all below it.
+func (ig *ignorer) ignoredDir(p string) bool {
+	rel, err := filepath.Rel(ig.root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	return ig.dirIgnored(filepath.ToSlash(rel))
+}
+
+func (ig *ignorer) dirIgnored(dir string) bool {
+	ignored, ok := ig.dirs[dir]
+	if !ok {
+		parent := path.Dir(dir)
+		ignored = parent != "." && ig.dirIgnored(parent) || ig.match(dir, true)
+		ig.dirs[dir] = ignored
+	}
+	return ignored
+}
+
+// match applies the rules of the directories above rel, from the root
+// down, to rel; the last rule matching decides.
+func (ig *ignorer) match(rel string, isDir bool) bool {
+	base := path.Base(rel)
+	if strings.HasPrefix(base, ".") {
+		return true
+	}
+	ignored := false
+	dir := ""
+	for {
+		sub := strings.TrimPrefix(rel, dir)
+		for _, r := range ig.load(dir) {
+			target := base
+			if r.anchored {
+				target = sub
+			}
+			if (isDir || !r.dirOnly) && r.re.MatchString(target) {
+				ignored = !r.negate
+			}
+		}
+		i := strings.IndexByte(sub, '/')
+		if i < 0 {
+			return ignored
+		}
+		dir += sub[:i+1]
+	}
+}
+
+// load returns the rules of the ignore files in dir, which is empty or
+// ends in a slash.
+func (ig *ignorer) load(dir string) []ignoreRule {
+	rules, ok := ig.rules[dir]
+	if !ok {
+		for _, name := range ignoreFiles {
+			if data, err := ig.readFile(filepath.Join(ig.root, filepath.FromSlash(dir), name)); err == nil || err == errChanged {
+				rules = append(rules, parseIgnore(data)...)
+			}
+		}
+		ig.rules[dir] = rules
+	}
+	return rules
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// jsonlExts are the extensions of files that are JSON lines whatever their
+// content looks like.
+var jsonlExts = map[string]bool{
+	".jsonl":     true,
+	".ndjson":    true,
+	".jsonlines": true,
+}
+
+// A jsonlField restricts matching in JSON-lines files to one field of each
+// record.
+type jsonlField struct {
+	path    []string // keys, or indexes into arrays, from the record down
+	pattern string
+}
+
+// parseJSONLField parses -jsonl-field's key=pattern, where key is a dotted
+// path such as request.headers.0. The pattern may not be empty, as it
+// would match every record, like an empty pattern argument.
+func parseJSONLField(s string) (*jsonlField, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("bad -jsonl-field %q: want key=pattern", s)
+	}
+	if i == len(s)-1 {
+		return nil, fmt.Errorf("bad -jsonl-field %q: empty pattern: it matches every record", s)
+	}
+	return &jsonlField{strings.Split(s[:i], "."), s[i+1:]}, nil
+}
+
+// isJSONL reports whether the file named name, with content data, holds
+// JSON lines: it has a JSON-lines extension, or its first record is a JSON
+// object.
+func isJSONL(name string, data, delim []byte) bool {
+	if jsonlExts[filepath.Ext(name)] {
+		return true
+	}
+	first := data
+	if i := bytes.Index(data, delim); i >= 0 {
+		first = data[:i]
+	}
+	first = bytes.TrimSpace(first)
+	return len(first) > 0 && first[0] == '{' && json.Valid(first)
+}
+
+// matchJSONL is match for queries with a jsonlField: it reports whether the
+// field of any record of data matches the field's pattern, and returns
+// those records, numbered, if q asks for line numbers. Files that are not
+// JSON lines never match.
+func (q *query) matchJSONL(name string, data []byte) (bool, []line) {
+	delim := q.delim
+	if delim == nil {
+		delim = []byte{'\n'}
+	}
+	if !isJSONL(name, data, delim) {
+		return false, nil
+	}
+	fq := *q
+	fq.pattern, fq.field, fq.lineNumbers, fq.scope, fq.goScope = q.field.pattern, nil, false, anyText, ""
+
+	var lines []line
+	for n, rec := range bytes.Split(data, delim) {
+		if len(bytes.TrimSpace(rec)) == 0 {
+			continue
+		}
+		v, ok := jsonlValue(rec, q.field.path)
+		if !ok {
+			continue
+		}
+		if ok, _ := fq.match(name, v); !ok {
+			continue
+		}
+		if !q.lineNumbers {
+			return true, nil
+		}
+		lines = append(lines, line{N: n + 1, Text: clipLine(rec, 0, 0, q.maxLine)})
+	}
+	return len(lines) > 0, lines
+}
+
+// jsonlValue returns the text of the value at path in the JSON record rec:
+// a string's contents, or the JSON encoding of anything else.
+func jsonlValue(rec []byte, path []string) ([]byte, bool) {
+	d := json.NewDecoder(bytes.NewReader(rec))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, false
+	}
+	for _, key := range path {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			v = x[i]
+		default:
+			return nil, false
+		}
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s), true
+	}
+	b, err := json.Marshal(v)
+	return b, err == nil
+}
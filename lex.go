@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+)
+
+// A textKind says what a stretch of source code is.
+type textKind uint8
+
+const (
+	anyText textKind = iota
+	codeText
+	commentText
+	stringText
+)
+
+// textKinds are the values -scope accepts.
+var textKinds = map[string]textKind{
+	"code":     codeText,
+	"comments": commentText,
+	"strings":  stringText,
+}
+
+// A syntax is just enough of a language's lexical grammar to tell code,
+// comments and string literals apart.
+type syntax struct {
+	lineComment  string
+	blockComment [2]string
+	quotes       []quote // longest delimiter first
+
+	// wordComments means lineComment only starts a comment at the start
+	// of a word, as # does in shell.
+	wordComments bool
+}
+
+type quote struct {
+	delim     string
+	escapes   bool // backslash escapes the next byte
+	multiline bool
+}
+
+var (
+	goSyntax = &syntax{
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes: []quote{
+			{"`", false, true},
+			{`"`, true, false},
+			{"'", true, false},
+		},
+	}
+	cSyntax = &syntax{
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes: []quote{
+			{`"`, true, false},
+			{"'", true, false},
+		},
+	}
+	jsSyntax = &syntax{
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes: []quote{
+			{"`", true, true},
+			{`"`, true, false},
+			{"'", true, false},
+		},
+	}
+	pythonSyntax = &syntax{
+		lineComment: "#",
+		quotes: []quote{
+			{`"""`, true, true},
+			{`'''`, true, true},
+			{`"`, true, false},
+			{"'", true, false},
+		},
+	}
+	shellSyntax = &syntax{
+		lineComment:  "#",
+		wordComments: true,
+		quotes: []quote{
+			{`"`, true, true},
+			{"'", false, true},
+		},
+	}
+)
+
+// syntaxes maps file extensions to the syntax of their language.
+var syntaxes = map[string]*syntax{
+	".go":   goSyntax,
+	".c":    cSyntax,
+	".h":    cSyntax,
+	".cc":   cSyntax,
+	".cpp":  cSyntax,
+	".cxx":  cSyntax,
+	".hh":   cSyntax,
+	".hpp":  cSyntax,
+	".cs":   cSyntax,
+	".java": cSyntax,
+	".kt":   cSyntax,
+	".m":    cSyntax,
+	".js":   jsSyntax,
+	".jsx":  jsSyntax,
+	".mjs":  jsSyntax,
+	".cjs":  jsSyntax,
+	".ts":   jsSyntax,
+	".tsx":  jsSyntax,
+	".py":   pythonSyntax,
+	".pyw":  pythonSyntax,
+	".sh":   shellSyntax,
+	".bash": shellSyntax,
+	".zsh":  shellSyntax,
+	".ksh":  shellSyntax,
+}
+
+// syntaxOf returns the syntax of the file named name, or nil if its
+// language is not known.
+func syntaxOf(name string) *syntax {
+	return syntaxes[filepath.Ext(name)]
+}
+
+// kinds returns the kind of every byte of data. Unterminated comments and
+// strings run to the end of the file, or of the line for single-line
+// strings.
+func (syn *syntax) kinds(data []byte) []textKind {
+	kinds := make([]textKind, len(data))
+	mark := func(start, end int, k textKind) int {
+		for i := start; i < end; i++ {
+			kinds[i] = k
+		}
+		return end
+	}
+
+	for i := 0; i < len(data); {
+		rest := data[i:]
+		if syn.lineComment != "" && bytes.HasPrefix(rest, []byte(syn.lineComment)) &&
+			(!syn.wordComments || i == 0 || isWordBreak(data[i-1])) {
+			end := bytes.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			i = mark(i, i+end, commentText)
+			continue
+		}
+		if open := syn.blockComment[0]; open != "" && bytes.HasPrefix(rest, []byte(open)) {
+			end := bytes.Index(rest[len(open):], []byte(syn.blockComment[1]))
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(open) + len(syn.blockComment[1])
+			}
+			i = mark(i, i+end, commentText)
+			continue
+		}
+		if q := syn.quoteAt(rest); q != nil {
+			i = mark(i, i+q.end(rest), stringText)
+			continue
+		}
+		kinds[i] = codeText
+		i++
+	}
+	return kinds
+}
+
+// quoteAt returns the quote opening a string literal at the start of b, if
+// any.
+func (syn *syntax) quoteAt(b []byte) *quote {
+	for i := range syn.quotes {
+		if bytes.HasPrefix(b, []byte(syn.quotes[i].delim)) {
+			return &syn.quotes[i]
+		}
+	}
+	return nil
+}
+
+// end returns the length of the string literal at the start of b, which
+// begins with q's delimiter.
+func (q *quote) end(b []byte) int {
+	for i := len(q.delim); i < len(b); i++ {
+		switch {
+		case q.escapes && b[i] == '\\':
+			i++
+		case !q.multiline && b[i] == '\n':
+			return i
+		case bytes.HasPrefix(b[i:], []byte(q.delim)):
+			return i + len(q.delim)
+		}
+	}
+	return len(b)
+}
+
+// isWordBreak reports whether a shell word ends before c.
+func isWordBreak(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ';' || c == '|' || c == '&'
+}
@@ -1,107 +1,738 @@
 package main
 
 import (
-	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"golang.org/x/net/context"
-	"golang.org/x/sync/errgroup"
-	
-	"github.com/nilium/glob"
 )
 
+// A query is what search looks for in each file below the roots.
+type query struct {
+	pattern     string
+	filepattern string
+	files       *regexp.Regexp // filepattern compiled, if set
+	ignoreCase  bool
+	lineNumbers bool
+
+	// untilStable, if set, ends the search once this long has passed
+	// without a new hit.
+	untilStable time.Duration
+
+	// ident restricts matches to whole identifiers.
+	ident bool
+
+	// scope restricts matches in source files of known languages to code,
+	// comments or string literals.
+	scope textKind
+
+	// goScope restricts matches in Go files to one of goScopes.
+	goScope string
+
+	// clock times -go-scope parses, the real clock if nil. A pipeline
+	// sets it to its own.
+	clock clock
+
+	// hash, if set, is which of hashes to compute a digest of each
+	// matching file with.
+	hash string
+
+	// delim ends the records reported as lines, if not a newline.
+	delim []byte
+
+	// field, if set, replaces pattern: only JSON-lines files are searched,
+	// and only in the given field of each record.
+	field *jsonlField
+
+	// columns, if set, restricts matches in CSV and TSV files to these
+	// columns.
+	columns csvColumns
+
+	// since skips files last modified before it. With a timeLayout,
+	// only records stamped between since and until match.
+	since, until time.Time
+	timeLayout   string
+
+	// maxFiles, if set, caps the number of files searched, and maxBytes
+	// their total size.
+	maxFiles int
+	maxBytes int64
+
+	// maxMem, if set, caps the bytes of file content held in memory at
+	// once. Larger files are skipped, unless read a chunk at a time.
+	maxMem int64
+
+	// profiles say how the files fitting them are read, the first a file
+	// fits applying.
+	profiles []readProfile
+
+	// entropy, if set, is the bits per character above which strings of
+	// base64 or hex characters match too, as likely secrets.
+	entropy float64
+
+	// maxLine, if set, is how much of a line is reported, and with skipLong
+	// files with a longer line are not searched at all.
+	maxLine  int
+	skipLong bool
+
+	// compat is the tool whose conventions to follow: "" or "rg", which
+	// honors ignore files and skips hidden files.
+	compat string
+
+	// binaryFiles is what to do with files that look binary: report them
+	// without their lines ("binary", also meant by ""), skip them
+	// ("without-match"), or search them as text ("text").
+	binaryFiles string
+
+	// retries is how many more times to try a read that fails with a
+	// transient error, waiting retryBackoff before the first retry and
+	// twice as long before each one after.
+	retries      int
+	retryBackoff time.Duration
+
+	// def ranks the files where the pattern is likely defined first.
+	def bool
+
+	// blame annotates the lines reported with their last commit.
+	blame bool
+
+	// maxDepth, if set, is how deep below a root directories are walked.
+	maxDepth int
+
+	// contain skips files whose path, symbolic links resolved, leads out
+	// of the root they were found below.
+	contain bool
+
+	// list, set for an empty pattern with -allow-empty, makes every file
+	// that would be searched a hit, without reading it.
+	list bool
+
+	// own are the files the search is not to look at, as rtgrep itself
+	// writes them.
+	own ownFiles
+
+	// progress, if set, is kept up to date as the search goes, and onHit,
+	// if set, is called with each hit as it is found.
+	progress *progress
+	onHit    func(hit)
+}
+
+// hashes are the digests -hash can compute.
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// A request is a search as given on the command line, in a form that can
+// also be sent to a daemon.
+type request struct {
+	Roots       []string
+	Timeout     time.Duration
+	Pattern     string
+	FilePattern string
+	IgnoreCase  bool
+	LineNumbers bool
+	UntilStable time.Duration
+	Ident       bool
+	Scope       string
+	GoScope     string
+	Hash        string
+	RecordDelim string
+	JSONLField  string
+	Columns     string
+	Since       string
+	Until       string
+	TimeLayout  string
+	MaxFiles    int
+	MaxBytes    int64
+	MaxMem      int64
+	ReadProfile []string
+	Entropy     float64
+	MaxLineLen  int
+	SkipLong    bool
+	Compat      string
+	BinaryFiles string
+	Retries     int
+	Backoff     time.Duration
+	Own         []string // absolute paths of the files rtgrep writes to
+	Def         bool
+	Blame       bool
+	MaxDepth    int
+	AllowEmpty  bool
+	Contain     bool
+	Token       string // for a daemon run with -token
+
+	// Limit, if set, has a daemon answer with the first Limit hits, and a
+	// cursor to ask for the next Limit with, in a request with only
+	// Cursor, Limit and Token set. The daemon keeps the hits of the
+	// search between pages, rather than searching again.
+	Limit  int
+	Cursor string
+}
+
+// query checks r and returns the query it asks for.
+func (r *request) query() (*query, error) {
+	q := &query{
+		pattern:     r.Pattern,
+		filepattern: r.FilePattern,
+		ignoreCase:  r.IgnoreCase,
+		lineNumbers: r.LineNumbers,
+		untilStable: r.UntilStable,
+		ident:       r.Ident,
+		def:         r.Def,
+		blame:       r.Blame,
+		maxDepth:    r.MaxDepth,
+		contain:     r.Contain,
+		maxFiles:    r.MaxFiles,
+		maxBytes:    r.MaxBytes,
+		maxMem:      r.MaxMem,
+		entropy:     r.Entropy,
+		maxLine:     r.MaxLineLen,
+		skipLong:    r.SkipLong,
+	}
+	q.retries, q.retryBackoff = r.Retries, r.Backoff
+	q.own = newOwnFiles(r.Own)
+	switch r.Compat {
+	case "", "rg":
+		q.compat = r.Compat
+	default:
+		return nil, fmt.Errorf("unknown -compat %q", r.Compat)
+	}
+	switch r.BinaryFiles {
+	case "", "binary", "without-match", "text":
+		q.binaryFiles = r.BinaryFiles
+	default:
+		return nil, fmt.Errorf("unknown -binary-files %q", r.BinaryFiles)
+	}
+	// With -jsonl-field, the pattern is the field's, which
+	// parseJSONLField does not let be empty.
+	if r.Pattern == "" && r.JSONLField == "" && r.Entropy == 0 {
+		// bytes.Contains finds an empty pattern in every file, so it
+		// would only list them all after reading them all.
+		if !r.AllowEmpty {
+			return nil, errors.New("empty pattern: it matches every file; give -allow-empty to list the files that would be searched, without reading them")
+		}
+		if r.LineNumbers || r.Hash != "" {
+			return nil, errors.New("-allow-empty lists files without reading them: it takes no -n, -hash, -blame or -by-ext")
+		}
+		q.list = true
+	}
+	if r.Blame && (!r.LineNumbers || r.RecordDelim != "") {
+		return nil, errors.New("-blame needs -n, and lines ending in newlines")
+	}
+	if r.SkipLong && r.MaxLineLen <= 0 {
+		return nil, errors.New("-skip-long-lines needs -max-line-length")
+	}
+	if r.Limit < 0 {
+		return nil, fmt.Errorf("bad limit %d", r.Limit)
+	}
+	if r.MaxDepth < 0 {
+		return nil, fmt.Errorf("bad -max-depth %d", r.MaxDepth)
+	}
+	if r.Retries < 0 || r.Backoff < 0 {
+		return nil, fmt.Errorf("bad -retries %d or -retry-backoff %v", r.Retries, r.Backoff)
+	}
+	if r.Entropy < 0 {
+		return nil, fmt.Errorf("bad -entropy %v", r.Entropy)
+	}
+	if r.Scope != "" {
+		q.scope = textKinds[r.Scope]
+		if q.scope == anyText {
+			return nil, fmt.Errorf("unknown -scope %q", r.Scope)
+		}
+	}
+	if r.GoScope != "" {
+		if !goScopes[r.GoScope] {
+			return nil, fmt.Errorf("unknown -go-scope %q", r.GoScope)
+		}
+		q.goScope = r.GoScope
+	}
+	if r.Hash != "" {
+		if hashes[r.Hash] == nil {
+			return nil, fmt.Errorf("unknown -hash %q", r.Hash)
+		}
+		q.hash = r.Hash
+	}
+	if r.RecordDelim != "" {
+		var err error
+		if q.delim, err = parseDelim(r.RecordDelim); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	if r.Since != "" {
+		var err error
+		if q.since, err = parseTimeFlag("since", r.Since, now); err != nil {
+			return nil, err
+		}
+	}
+	if r.Until != "" {
+		var err error
+		if q.until, err = parseTimeFlag("until", r.Until, now); err != nil {
+			return nil, err
+		}
+	}
+	q.timeLayout = r.TimeLayout
+	if r.Columns != "" {
+		q.columns = parseCSVColumns(r.Columns)
+	}
+	if r.JSONLField != "" {
+		var err error
+		if q.field, err = parseJSONLField(r.JSONLField); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range r.ReadProfile {
+		rp, err := parseReadProfile(spec)
+		if err != nil {
+			return nil, err
+		}
+		q.profiles = append(q.profiles, rp)
+	}
+	return q, nil
+}
+
+// delimNames are the names -record-delim accepts besides escaped strings.
+var delimNames = map[string]string{
+	"nul":  "\x00",
+	"cr":   "\r",
+	"lf":   "\n",
+	"crlf": "\r\n",
+}
+
+// parseDelim returns the record delimiter named by s: nul, cr, lf or crlf,
+// or a string in which Go escapes such as \x00 or \r are interpreted.
+func parseDelim(s string) ([]byte, error) {
+	if d, ok := delimNames[s]; ok {
+		return []byte(d), nil
+	}
+	d, err := strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	if err != nil || d == "" {
+		return nil, fmt.Errorf("bad -record-delim %q", s)
+	}
+	return []byte(d), nil
+}
+
+// A hit is a file containing the pattern. Lines holds the matching lines if
+// line numbers were asked for, and Sum the file's digest, in hex, if one
+// was, computed with the algorithm named by Hash. Binary is set instead of
+// Lines for files that look binary.
+type hit struct {
+	Path   string `json:"path"`
+	Lines  []line `json:"lines,omitempty"`
+	Sum    string `json:"sum,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Binary bool   `json:"binary,omitempty"`
+
+	// Changed is set if the file changed while it was read, so that the
+	// hit may not match what is in it now, or what was in it before.
+	Changed bool `json:"changed,omitempty"`
+
+	// Def is set, with -def, if the file likely defines the pattern.
+	Def bool `json:"def,omitempty"`
+}
+
+type line struct {
+	N     int    `json:"n"`
+	Text  string `json:"text"`
+	Def   bool   `json:"def,omitempty"`   // with -def, the line likely defines the pattern
+	Blame *blame `json:"blame,omitempty"` // with -blame, if git knows the line
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			daemon(os.Args[2:])
+			return
+		case "rpc":
+			rpc(os.Args[2:])
+			return
+		case "history":
+			history(os.Args[2:])
+			return
+		case "audit":
+			audit(os.Args[2:])
+			return
+		case "rerun":
+			os.Args = append(os.Args[:1], rerun(os.Args[2:])...)
+		}
+	}
+
 	duration := flag.Duration("timeout", 2000*time.Millisecond, "timeout in milliseconds")
-	path := flag.String("path", ".", "path to start from")
-	filepattern := flag.String("filepattern", "*", "file name pattern")
+	path := flag.String("path", ".", "path to start from, if none are given after the pattern")
+	filepattern := flag.String("filepattern", "*", "file name pattern, or with a slash, as in cmd/*/main.go, path pattern below each root, where * and ? do not match a slash and ** matches any number of directories")
+	ignoreCase := flag.Bool("ignore-case", false, "match case-insensitively, with Unicode simple case folding")
+	filesWithMatches := flag.Bool("files-with-matches", false, "only print the names of matching files (the default unless -n is set)")
+	lineNumbers := flag.Bool("line-number", false, "print matching lines prefixed with file name and line number")
+	untilStable := flag.Duration("until-stable", 0, "stop before the timeout once no new hits have been found for this long")
+	def := flag.Bool("def", false, "rank the files where the pattern is likely defined, as in func <pattern> or class <pattern>, above those that only refer to it")
+	blame := flag.Bool("blame", false, "with -n, annotate each matching line in a git repository with the commit that last changed it, its author and date")
+	ident := flag.Bool("ident", false, "match the pattern only as a whole identifier: not preceded or followed by a letter, digit or _ (or $ in JavaScript)")
+	scope := flag.String("scope", "", "in source files of known languages, only match in code, comments or strings")
+	goScope := flag.String("go-scope", "", "in Go files, only match in function bodies, import declarations or struct tags: func, import or struct-tag")
+	hashName := flag.String("hash", "", "print a digest of each matching file, in sha256sum format: md5, sha1, sha256 or sha512")
+	recordDelim := flag.String("record-delim", "", "with -n, split lines at this delimiter instead of newlines: nul, cr, lf, crlf or a string with Go escapes like \\x1e")
+	jsonlField := flag.String("jsonl-field", "", "search JSON-lines files only, matching pattern against the given field of each record: key=pattern, with dotted keys like req.path; no pattern argument is taken")
+	columns := flag.String("column", "", "in .csv and .tsv files, only match in these comma-separated columns, given by header name or 1-based index; -n prints row numbers")
+	since := flag.String("since", "", "skip files last modified before this time (2006-01-02 15:04:05, RFC 3339, or a duration ago like 2h); with -time-layout, only match records stamped since then")
+	until := flag.String("until", "", "with -time-layout, only match records stamped until this time")
+	timeLayout := flag.String("time-layout", "", "Go time layout of the timestamp starting each record, for -since and -until, e.g. \"2006-01-02 15:04:05\"")
+	maxFiles := flag.Int("max-files", 0, "search at most this many files, and report how many more there were")
+	maxBytes := flag.String("max-bytes", "", "search files adding up to at most this many bytes, e.g. 1G, and report if there were more")
+	maxLineLength := flag.Int("max-line-length", 0, "report at most this many bytes of a matching line, around the match")
+	skipLongLines := flag.Bool("skip-long-lines", false, "skip files with a line longer than -max-line-length, such as minified code")
+	entropy := flag.Float64("entropy", 0, "also match strings of base64 or hex characters with at least this many bits of entropy per character, such as keys and tokens; 4.5 suits base64, 3.5 hex; an empty pattern matches only those")
+	allowEmpty := flag.Bool("allow-empty", false, "take an empty pattern to list the files that would be searched, without reading them")
+	summarizeAbove := flag.Int("summarize-above", 1000, "when more files than this match, and they are over 90% of those searched, as with a pattern matching everything, print counts per file extension instead of the hits; 0 to always print the hits")
+	contain := flag.Bool("contain", false, "skip files whose path, with symbolic links resolved, leads out of the root they were found below, as when a directory is swapped for a link while the search runs")
+	maxDepth := flag.Int("max-depth", 256, "walk at most this many directories deep below each root, skipping deeper ones with a warning; 0 for no limit")
+	maxMem := flag.String("max-mem", "", "hold at most this many bytes of file content in memory at once, e.g. 512M; larger files are skipped, unless -read-profile reads them in chunks that fit")
+	compat := flag.String("compat", "", "follow the conventions of another tool: rg honors .gitignore, .ignore and .rgignore files, skips hidden files and reads options from $RIPGREP_CONFIG_PATH")
+	binaryFiles := flag.String("binary-files", "binary", "what to do with files containing a NUL byte: binary reports \"Binary file X matches\" instead of their lines, without-match skips them, text searches them as text")
+	retries := flag.Int("retries", 2, "retry reads failing with an I/O error or a timeout, as on flaky network mounts, up to this many times")
+	backoff := flag.Duration("retry-backoff", 100*time.Millisecond, "wait this long before the first retry of a read, and twice as long before each retry after")
+	recordTrace := flag.String("record", "", "write a trace of the search to this file for -replay, with the content of every file read")
+	replayTrace := flag.String("replay", "", "instead of searching, replay the search traced by -record in this file, on its recorded timing; no pattern argument is taken")
+	noEstimate := flag.Bool("no-estimate", false, "do not sample the tree first to warn if it is far too large to search before the timeout")
+	byExt := flag.Bool("by-ext", false, "instead of the hits, print how many files and lines have hits per file extension; short for -n -sink by-ext")
+	var profiles profileFlags
+	flag.Var(&profiles, "read-profile", "read the files fitting this profile as it says, repeatable, the first fitting applying: comma-separated ext=.log|.txt and min-size=64M pick the files, chunk=4M reads and matches them that many bytes at a time, readers=1 reads at most that many of them at once")
+	var sinks sinkFlags
+	flag.Var(&sinks, "sink", "where to send results, repeatable: text[:file=path], json[:file=path] for a JSON object per line, http:[batch=n,]url=address to POST those lines in batches, or by-ext[:file=path] for counts per file extension; text to stdout by default")
+	noDaemon := flag.Bool("no-daemon", false, "search directly even if an rtgrep daemon is running")
+	printStats := flag.Bool("stats", false, "print statistics about the search to stderr")
+	federateHosts := flag.String("federate", "", "run the search on the hosts listed in this file, one per line, each by rtgrep rpc over ssh, and merge their hits as host:path; roots are paths on the hosts")
+	detectEnc := flag.Bool("detect-encodings", false, "instead of searching, report the encodings of the files below the paths given as arguments, per file extension")
+	alias("filepattern", "g", "glob")
+	alias("ignore-case", "i")
+	alias("files-with-matches", "l")
+	alias("line-number", "n")
 	flag.Usage = func() {
 		fmt.Printf("%s recursively almost-greps until timeout. pattern is checked byte for byte. Original: bketelsen's gogrep.\n", os.Args[0])
-		fmt.Printf("Usage: %v [flags] pattern\n", os.Args[0])
-		flag.PrintDefaults()
+		fmt.Printf("Usage: %v [flags] pattern [path ...]\n", os.Args[0])
+		fmt.Printf("       %v -jsonl-field key=pattern [flags] [path ...]\n", os.Args[0])
+		fmt.Printf("       %v -federate hosts.txt [flags] pattern [path ...]\n", os.Args[0])
+		fmt.Printf("       %v -detect-encodings [flags] [path ...]\n", os.Args[0])
+		fmt.Printf("       %v -replay trace [flags]\n", os.Args[0])
+		fmt.Printf("       %v daemon [-socket path] [-allow [ceilings,]dir ...] [-token file] [-audit file|syslog -audit-key file]\n", os.Args[0])
+		fmt.Printf("       %v rpc [-progress interval] [-audit file|syslog -audit-key file]\n", os.Args[0])
+		fmt.Printf("       %v audit [-key file] log\n", os.Args[0])
+		fmt.Printf("       %v history [-n count]\n", os.Args[0])
+		fmt.Printf("       %v rerun [N] [flags]\n", os.Args[0])
+		fmt.Printf("Searches are kept for history and rerun only if $RTGREP_HISTORY names the file to keep them in, which is made\n")
+		fmt.Printf("readable by its owner only: it holds the patterns searched for, tokens and secrets hunted for included.\n")
+		printFlags()
+	}
+	cmdline := expandShort(flag.CommandLine, os.Args[1:])
+	flag.CommandLine.Parse(cmdline)
+	// The flags as given, for the history.
+	cmdFlags := cmdline[:len(cmdline)-flag.NArg()]
+	if *compat == "rg" {
+		// Options on the command line override those in the config.
+		args, err := rgConfigArgs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// -sink and -read-profile add up rather than override, so forget
+		// those of the first parse, which are parsed again.
+		sinks, profiles = nil, nil
+		flag.CommandLine.Parse(expandShort(flag.CommandLine, append(args, os.Args[1:]...)))
+	}
+	if *detectEnc {
+		roots := flag.Args()
+		if len(roots) == 0 {
+			roots = []string{*path}
+		}
+		ctx, _ := context.WithTimeout(context.Background(), *duration)
+		counts, skipped, err := detectEncodings(ctx, dedupeRoots(roots), *filepattern, walkDisk)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printEncodings(os.Stdout, counts)
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "not sampled: %d files or directories that vanished or could not be read\n", skipped)
+		}
+		return
 	}
-	flag.Parse()
-	if flag.NArg() != 1 {
-		flag.Usage()
-		os.Exit(-1)
+	args := flag.Args()
+	var pattern string
+	if *jsonlField == "" && *replayTrace == "" {
+		if len(args) < 1 {
+			flag.Usage()
+			os.Exit(-1)
+		}
+		pattern, args = args[0], args[1:]
 	}
-	pattern := flag.Arg(0)
-	ctx, _ := context.WithTimeout(context.Background(), *duration)
-	m, err := search(ctx, *path, pattern,  *filepattern)
+	r := &request{
+		Roots:       args,
+		Timeout:     *duration,
+		Pattern:     pattern,
+		FilePattern: *filepattern,
+		IgnoreCase:  *ignoreCase,
+		LineNumbers: *lineNumbers && !*filesWithMatches || *byExt,
+		UntilStable: *untilStable,
+		Ident:       *ident,
+		Def:         *def,
+		Blame:       *blame,
+		MaxDepth:    *maxDepth,
+		AllowEmpty:  *allowEmpty,
+		Contain:     *contain,
+		Scope:       *scope,
+		GoScope:     *goScope,
+		Hash:        *hashName,
+		RecordDelim: *recordDelim,
+		JSONLField:  *jsonlField,
+		Columns:     *columns,
+		Since:       *since,
+		Until:       *until,
+		TimeLayout:  *timeLayout,
+		MaxFiles:    *maxFiles,
+		Entropy:     *entropy,
+		MaxLineLen:  *maxLineLength,
+		SkipLong:    *skipLongLines,
+		Compat:      *compat,
+		BinaryFiles: *binaryFiles,
+		Retries:     *retries,
+		Backoff:     *backoff,
+		ReadProfile: profiles,
+	}
+	if *maxMem != "" {
+		n, err := parseSize(*maxMem)
+		if err != nil {
+			log.Fatalf("bad -max-mem: %v", err)
+		}
+		r.MaxMem = n
+	}
+	if *maxBytes != "" {
+		n, err := parseSize(*maxBytes)
+		if err != nil {
+			log.Fatalf("bad -max-bytes: %v", err)
+		}
+		r.MaxBytes = n
+	}
+	if len(r.Roots) == 0 {
+		r.Roots = []string{*path}
+	}
+	nroots := len(r.Roots)
+	if *federateHosts == "" {
+		// The roots of -federate are not on this disk.
+		r.Roots = dedupeRoots(r.Roots)
+	}
+	var rp *replay
+	if *replayTrace != "" {
+		var err error
+		if rp, err = loadTrace(*replayTrace); err != nil {
+			log.Fatal(err)
+		}
+		r = &rp.header.Request
+		nroots = len(r.Roots)
+	}
+	if *byExt {
+		sinks = append(sinks, "by-ext")
+	}
+	if len(sinks) == 0 {
+		sinks = sinkFlags{"text"}
+	}
+	out := new(fanout)
+	for _, spec := range sinks {
+		s, err := parseSink(spec, r.LineNumbers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if t, ok := s.(*textSink); ok {
+			t.summarizeAbove = *summarizeAbove
+		}
+		out.add(spec, s)
+	}
+	// The sinks' files are created by now, so that the search can tell
+	// them apart from the files it finds.
+	r.Own = ownPaths(sinks, *recordTrace)
+	q, err := r.query()
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, name := range m {
-		fmt.Println(name)
-	}
-	fmt.Println(len(m), "hits")
-}
-
-func search(ctx context.Context, root string, pattern string, filepattern string) ([]string, error) {
-	g, ctx := errgroup.WithContext(ctx)
-	paths := make(chan string, 100)
-	// get all the paths
-
-	g.Go(func() error {
-		defer close(paths)
-
-		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
+	q.own.addStdout()
+	q.onHit = out.found
+	var m []hit
+	var st stats
+	err = errNoDaemon
+	switch {
+	case *federateHosts != "":
+		if *recordTrace != "" || rp != nil {
+			log.Fatal("-federate takes no -record or -replay")
+		}
+		m, st, err = searchHosts(*federateHosts, r, out.found)
+	case !*noDaemon && *recordTrace == "" && rp == nil:
+		m, st, err = searchDaemon(r)
+		if err == nil {
+			for _, h := range m {
+				out.found(h)
 			}
-			if !info.Mode().IsRegular() {
-				return nil
+		}
+	}
+	if err == errNoDaemon {
+		s := newSearcher(walkDisk)
+		var trace *os.File
+		var rec *recorder
+		switch {
+		case rp != nil:
+			// Traces hold whole reads, so files are read whole.
+			s.walk, s.readFile, s.open, s.clock = rp.walk, rp.readFile, nil, rp.clock
+		case *recordTrace != "":
+			if trace, err = os.Create(*recordTrace); err != nil {
+				log.Fatal(err)
 			}
-			ok, err := glob.Matches(glob.PatternStr(filepattern), info.Name()) 
-			if err != nil {
-				return nil
+			rec = newRecorder(trace, r, s.clock)
+			s.walk, s.readFile, s.open = rec.walker(s.walk), rec.readFile(s.readFile), nil
+		}
+		q.progress = new(progress)
+		if !*noEstimate && rp == nil {
+			if files, err := s.pattern(q.filepattern); err == nil {
+				rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+				est := estimateTree(r.Roots, files, ioutil.ReadDir, rnd, time.Now().Add(estimateTime))
+				if w := est.warning(r.Timeout); w != "" {
+					fmt.Fprintln(os.Stderr, w)
+				}
+				q.progress.estimate = est.files
 			}
-			if !info.IsDir() && !ok{
-				return nil
+		}
+		ctx, cancel := s.clock.WithTimeout(context.Background(), r.Timeout)
+		reportStatus(ctx, q.progress, os.Stderr)
+		m, st, err = s.search(ctx, r.Roots, q)
+		cancel()
+		if rec != nil {
+			if ferr := rec.flush(); err == nil {
+				err = ferr
 			}
-
-			select {
-			case paths <- path:
-			case <-ctx.Done():
-				return ctx.Err()
+			if cerr := trace.Close(); err == nil {
+				err = cerr
 			}
-			return nil
-		})
-
-	})
-
-	c := make(chan string, 100)
-	for path := range paths {
-		p := path
-		g.Go(func() error {
-			data, err := ioutil.ReadFile(p)
-			if err != nil {
-				return err
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	st.CollapsedRoots = nroots - len(r.Roots)
+	if err := out.finish(m, st); err != nil {
+		log.Print(err)
+	}
+	if s := st.skips(); s != "" {
+		fmt.Fprintf(os.Stderr, "not searched: %s\n", s)
+	}
+	for _, h := range m {
+		if h.Changed {
+			fmt.Fprintf(os.Stderr, "%s changed while it was searched: its hit may be unstable\n", h.Path)
+		}
+	}
+	if st.TooDeep > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d directories nested deeper than -max-depth %d or with too long a path, the first %s\n", st.TooDeep, r.MaxDepth, st.TooDeepPath)
+	}
+	if matchesEverything(m, st, *summarizeAbove) {
+		fmt.Fprintf(os.Stderr, "%d of %d files searched match: printed counts per file extension instead; -summarize-above 0 prints the hits\n", len(m), st.Searched)
+	}
+	switch st.Truncated {
+	case "":
+	case "max-files", "max-bytes":
+		fmt.Fprintf(os.Stderr, "-%s reached: the walk stopped with more files left to search\n", st.Truncated)
+	default:
+		fmt.Fprintf(os.Stderr, "search stopped early (%s): results may be incomplete\n", st.Truncated)
+	}
+	if st.Truncated != "" && st.LastPath != "" {
+		where := fmt.Sprintf("the walk stopped in %s", filepath.Dir(st.LastPath))
+		// A replay's roots are not on this disk.
+		if rp == nil {
+			if covered, total := st.coverage(r.Roots, ioutil.ReadDir); total > 0 {
+				where += fmt.Sprintf(", through %d of %d top-level entries (%d%%)", covered, total, 100*covered/total)
 			}
-			if !bytes.Contains(data, []byte(pattern)) {
-				return nil
+		}
+		fmt.Fprintln(os.Stderr, where)
+	}
+	if *printStats {
+		st.print(os.Stderr)
+	}
+	if rp == nil {
+		recordHistory(cmdFlags, flag.Args(), len(m), st.Truncated)
+	}
+}
+
+// dedupeRoots returns roots without those that are the same as or inside
+// another root once made absolute and symlinks are resolved, so that no file
+// is searched twice. The remaining roots keep their order and spelling.
+func dedupeRoots(roots []string) []string {
+	resolved := make([]string, len(roots))
+	for i, root := range roots {
+		resolved[i] = resolvePath(root)
+	}
+	var kept []string
+	for i, root := range roots {
+		dup := false
+		for j := range roots {
+			if i == j {
+				continue
 			}
-			select {
-			case c <- p:
-			case <-ctx.Done():
-				return ctx.Err()
+			rel, err := filepath.Rel(resolved[j], resolved[i])
+			inside := err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+			// Of two equal roots, keep the first.
+			if inside && (rel != "." || j < i) {
+				dup = true
+				break
 			}
-			return nil
-		})
+		}
+		if !dup {
+			kept = append(kept, root)
+		}
 	}
-	go func() {
-		g.Wait()
-		close(c)
-	}()
+	return kept
+}
 
-	var m []string
-	for r := range c {
-		m = append(m, r)
+// within reports whether path is dir or lies below it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath returns path made absolute with symlinks resolved, or as much
+// of that as possible.
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return path
+}
+
+// parseSize parses a byte count with an optional k, M, G or T suffix for
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if i := strings.IndexAny(s, "kKmMgGtT"); i >= 0 && i == len(s)-1 {
+		mult = 1 << (10 * (1 + strings.IndexByte("kmgt", byte(unicode.ToLower(rune(s[i]))))))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", s)
 	}
-	return m, g.Wait()
+	return n * mult, nil
 }
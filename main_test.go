@@ -0,0 +1,2029 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+func TestSearchVanishedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gone.txt")
+	if err := ioutil.WriteFile(path, []byte("needle"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is listed, then removed before it is read.
+	walk := func(root string, fn walkFunc) error {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := fn(path, info, nil); err != nil {
+			return err
+		}
+		return fn(filepath.Join(root, "subdir"), nil, &os.PathError{Op: "lstat", Path: "subdir", Err: os.ErrNotExist})
+	}
+
+	m, st, err := search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "*"}, walk)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(m) != 0 {
+		t.Errorf("got hits %v, want none", m)
+	}
+	if st.Vanished != 2 {
+		t.Errorf("got %d vanished, want 2", st.Vanished)
+	}
+
+	// A root that is not there is an error, not a vanished file.
+	missing := filepath.Join(dir, "nonexistent")
+	if _, _, err := search(context.Background(), []string{dir, missing}, &query{pattern: "needle", filepattern: "*"}, walkDisk); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("search of %s: got %v, want it not to exist", missing, err)
+	}
+}
+
+func TestSearchChurningTree(t *testing.T) {
+	dir := t.TempDir()
+	stable := filepath.Join(dir, "stable.txt")
+	if err := ioutil.WriteFile(stable, []byte("needle"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sub := filepath.Join(dir, fmt.Sprintf("build%d-%d", w, i%8))
+				os.MkdirAll(filepath.Join(sub, "obj"), 0777)
+				for f := 0; f < 8; f++ {
+					ioutil.WriteFile(filepath.Join(sub, "obj", fmt.Sprintf("%d.o", f)), []byte("needle"), 0666)
+				}
+				os.RemoveAll(sub)
+			}
+		}(w)
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	q := &query{pattern: "needle", filepattern: "*"}
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		m, _, err := search(ctx, []string{dir}, q, walkDisk)
+		cancel()
+		if err != nil {
+			t.Fatalf("search %d: %v", i, err)
+		}
+		found := false
+		for _, h := range m {
+			found = found || h.Path == stable
+		}
+		if !found {
+			t.Fatalf("search %d: %s not found", i, stable)
+		}
+	}
+}
+
+func TestSearchMaxMem(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		data := append(make([]byte, 1000), "needle"...)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big.txt"), make([]byte, 5000), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query{pattern: "needle", filepattern: "*", maxMem: 2500}
+	m, st, err := search(context.Background(), []string{dir}, q, walkDisk)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(m) != 20 {
+		t.Errorf("got %d hits, want 20", len(m))
+	}
+	if st.TooLarge != 1 {
+		t.Errorf("got %d too large, want 1", st.TooLarge)
+	}
+}
+
+func TestReadProfile(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want readProfile
+		bad  bool
+	}{
+		{spec: "ext=.log|.txt,chunk=1M", want: readProfile{exts: []string{".log", ".txt"}, chunk: 1 << 20}},
+		{spec: "min-size=64M,readers=1", want: readProfile{minSize: 64 << 20, readers: 1}},
+		{spec: "ext=.log", bad: true},
+		{spec: "ext=log,readers=1", bad: true},
+		{spec: "chunk=1K", bad: true},
+		{spec: "readers=0", bad: true},
+		{spec: "readers", bad: true},
+		{spec: "size=1M,readers=1", bad: true},
+	} {
+		rp, err := parseReadProfile(tt.spec)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.spec, rp)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(rp, tt.want) {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.spec, rp, err, tt.want)
+		}
+	}
+
+	rp := readProfile{exts: []string{".log"}, minSize: 100, chunk: minChunk}
+	for _, tt := range []struct {
+		path string
+		size int64
+		want bool
+	}{
+		{"a.log", 100, true},
+		{"a.log", 99, false},
+		{"a.go", 100, false},
+	} {
+		if got := rp.fits(tt.path, tt.size); got != tt.want {
+			t.Errorf("fits(%q, %d) = %v, want %v", tt.path, tt.size, got, tt.want)
+		}
+	}
+
+	// Matches that may span lines need whole files.
+	for _, tt := range []struct {
+		q    query
+		want bool
+	}{
+		{query{pattern: "needle"}, true},
+		{query{pattern: "needle\nhay"}, false},
+		{query{pattern: "needle\nhay", delim: []byte{0}}, true},
+		{query{pattern: "needle", goScope: "func"}, false},
+		{query{pattern: "needle", scope: codeText}, false},
+	} {
+		if got := tt.q.chunkable(); got != tt.want {
+			t.Errorf("%q: chunkable = %v, want %v", tt.q.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSkipBuckets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.log"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("needle"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip(err)
+	}
+	walk := func(root string, fn walkFunc) error {
+		err := fn(filepath.Join(root, "private"), nil, &os.PathError{Op: "open", Path: "private", Err: os.ErrPermission})
+		if err != nil {
+			return err
+		}
+		return walkDisk(root, fn)
+	}
+
+	m, st, err := search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "*.txt"}, walk)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(m) != 1 {
+		t.Errorf("got hits %v, want 1", m)
+	}
+	if got, want := st.skips(), "1 permission denied, 1 special, 1 ignored"; got != want {
+		t.Errorf("got skips %q, want %q", got, want)
+	}
+}
+
+func TestSearcherReuse(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("needle haystack"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newSearcher(walkDisk)
+	for _, tc := range []struct {
+		pattern, files string
+		want           int
+	}{
+		{"needle", "*.txt", 1},
+		{"haystack", "*", 2},
+		{"needle", "*.txt", 1},
+		{"nothing", "*.go", 0},
+	} {
+		m, _, err := s.search(context.Background(), []string{dir}, &query{pattern: tc.pattern, filepattern: tc.files})
+		if err != nil {
+			t.Fatalf("search %q in %q: %v", tc.pattern, tc.files, err)
+		}
+		if len(m) != tc.want {
+			t.Errorf("search %q in %q: got %d hits, want %d", tc.pattern, tc.files, len(m), tc.want)
+		}
+	}
+	if len(s.patterns) != 3 {
+		t.Errorf("got %d compiled patterns, want 3", len(s.patterns))
+	}
+}
+
+func TestRPCSearch(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hay\nneedle\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(request{Roots: []string{dir}, Pattern: "needle", LineNumbers: true})
+	in := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"search","params":%s}
+{"jsonrpc":"2.0","id":2,"method":"nonesuch"}
+`, params)
+
+	var out bytes.Buffer
+	srv := &rpcServer{
+		s:        newSearcher(walkDisk),
+		interval: time.Hour,
+		enc:      json.NewEncoder(&out),
+		running:  make(map[string]context.CancelFunc),
+	}
+	srv.serve(strings.NewReader(in))
+
+	var hits, results, errs int
+	dec := json.NewDecoder(&out)
+	for {
+		var m struct {
+			ID     json.RawMessage
+			Method string
+			Params struct{ Lines []line }
+			Result *stats
+			Error  *rpcError
+		}
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		switch {
+		case m.Method == "hit":
+			hits++
+			if len(m.Params.Lines) != 1 || m.Params.Lines[0].N != 2 {
+				t.Errorf("got hit lines %v, want line 2", m.Params.Lines)
+			}
+		case m.Result != nil && string(m.ID) == "1":
+			results++
+			if m.Result.Matched != 1 {
+				t.Errorf("got %d matched, want 1", m.Result.Matched)
+			}
+		case m.Error != nil && string(m.ID) == "2":
+			errs++
+		default:
+			t.Errorf("unexpected message %+v", m)
+		}
+	}
+	if hits != 1 || results != 1 || errs != 1 {
+		t.Errorf("got %d hits, %d results, %d errors; want 1 of each", hits, results, errs)
+	}
+}
+
+// pipeConn is a hostConn to an rpcServer in the test.
+type pipeConn struct {
+	io.Reader
+	w *io.PipeWriter
+	r *io.PipeReader
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *pipeConn) Close() error {
+	c.w.Close()
+	return c.r.Close()
+}
+
+func TestFederate(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hay\nneedle\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(hostsFile, []byte("# hosts\none\n\n  two\nsilent\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := readHosts(hostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two", "silent"}; !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("readHosts got %q, want %q", hosts, want)
+	}
+
+	dial := func(ctx context.Context, host string) (hostConn, error) {
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		if host == "silent" {
+			// Reads the request, and never answers.
+			go io.Copy(ioutil.Discard, inR)
+			return &pipeConn{outR, inW, outR}, nil
+		}
+		srv := &rpcServer{
+			s:        newSearcher(walkDisk),
+			interval: time.Hour,
+			enc:      json.NewEncoder(outW),
+			running:  make(map[string]context.CancelFunc),
+		}
+		go srv.serve(inR)
+		return &pipeConn{outR, inW, outR}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var found []string
+	results := federate(ctx, hosts, &request{Roots: []string{dir}, Pattern: "needle"}, dial, func(h hit) {
+		found = append(found, h.Path)
+	})
+	sort.Strings(found)
+	path := filepath.Join(dir, "a.txt")
+	if want := []string{"one:" + path, "two:" + path}; !reflect.DeepEqual(found, want) {
+		t.Errorf("found %q, want %q", found, want)
+	}
+	for _, res := range results {
+		switch {
+		case res.host == "silent":
+			if res.err == nil || !strings.Contains(res.err.Error(), "deadline") {
+				t.Errorf("silent host: got error %v, want the deadline", res.err)
+			}
+		case res.err != nil:
+			t.Errorf("%s: %v", res.host, res.err)
+		case res.st.Matched != 1:
+			t.Errorf("%s: got %d matched, want 1", res.host, res.st.Matched)
+		}
+	}
+}
+
+func TestEntropySpans(t *testing.T) {
+	for _, tc := range []struct {
+		text      string
+		threshold float64
+		want      string
+	}{
+		{`key = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"`, 4.5, "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"},
+		{"sha 3f786850e387550fdab836ed7e6dc881de23001b", 3.5, "3f786850e387550fdab836ed7e6dc881de23001b"},
+		{"sha 3f786850e387550fdab836ed7e6dc881de23001b", 4.5, ""},
+		{"internationalization localization", 3.5, ""},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", 0.5, ""},
+		{"short Zx9Qa", 1, ""},
+	} {
+		var got string
+		if spans := entropySpans([]byte(tc.text), tc.threshold); len(spans) > 0 {
+			got = tc.text[spans[0][0]:spans[0][1]]
+		}
+		if got != tc.want {
+			t.Errorf("entropySpans(%q, %v) found %q, want %q", tc.text, tc.threshold, got, tc.want)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	for _, tc := range []struct {
+		line      string
+		i, j, max int
+		want      string
+	}{
+		{"short", 0, 5, 10, "short"},
+		{"0123456789needle0123456789", 10, 16, 10, "…89needle01…"},
+		{"needle0123456789", 0, 6, 8, "needle01…"},
+		{"0123456789needle", 10, 16, 8, "…89needle"},
+		{"ééééé needle", 11, 17, 8, "… needle"},
+	} {
+		if got := clipLine([]byte(tc.line), tc.i, tc.j, tc.max); got != tc.want {
+			t.Errorf("clipLine(%q, %d, %d, %d) = %q, want %q", tc.line, tc.i, tc.j, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestHasLongLine(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		delim string
+		want  bool
+	}{
+		{"abc\ndef\n", "", false},
+		{"abc\ndefgh\n", "", true},
+		{"abcd\r\nabcd\r\n", "\r\n", false},
+		{"abcd\r\nabcde", "\r\n", true},
+	} {
+		var delim []byte
+		if tc.delim != "" {
+			delim = []byte(tc.delim)
+		}
+		if got := hasLongLine([]byte(tc.data), delim, 4); got != tc.want {
+			t.Errorf("hasLongLine(%q, %q, 4) = %v, want %v", tc.data, tc.delim, got, tc.want)
+		}
+	}
+}
+
+// refGlob is a brute-force matcher for globs of literal runes, ? and *,
+// to check globPattern against.
+func refGlob(pattern, str []rune) bool {
+	if len(pattern) == 0 {
+		return len(str) == 0
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(str); i++ {
+			if refGlob(pattern[1:], str[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(str) > 0 && refGlob(pattern[1:], str[1:])
+	}
+	return len(str) > 0 && pattern[0] == str[0] && refGlob(pattern[1:], str[1:])
+}
+
+// globAgrees reports whether globPattern agrees with path.Match, and for
+// globs without escapes with refGlob, on pattern against str. Inputs
+// outside their common ground agree: slashes, which path.Match treats
+// apart, character classes, which globs lack, and wildcards after *, which
+// globs reject.
+func globAgrees(pattern, str string) bool {
+	if strings.ContainsAny(pattern, "[/") || strings.Contains(str, "/") {
+		return true
+	}
+	p, err := newGlobPattern(pattern)
+	if err == errGlobSequence {
+		return true
+	}
+	want, perr := path.Match(pattern, str)
+	if (err != nil) != (perr != nil) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	if p.matches(str) != want {
+		return false
+	}
+	if utf8.ValidString(pattern) && utf8.ValidString(str) && !strings.Contains(pattern, `\`) {
+		return refGlob([]rune(pattern), []rune(str)) == want
+	}
+	return true
+}
+
+func TestGlobPattern(t *testing.T) {
+	for _, tc := range []struct{ pattern, str string }{
+		{"a*b*c", "abc"},
+		{"a*b*c", "abxbc"},
+		{"a*b*c", "abbbbc"},
+		{"a*b*c", "ab.b.cd"},
+		{"*.go", ".go"},
+		{"*.go", "x.go.go"},
+		{"*b", "b"},
+		{"?*x", "x"},
+		{"a?c*", "abc"},
+		{"*ab", "aab"},
+		{"x*yz", "xyyyz"},
+		{"日*語", "日本語"},
+		{`\\`, `\`},
+		{`a\\*`, `a\bc`},
+		{`a\*`, `a*`},
+		{`a\*`, `abc`},
+		{`\?`, `?`},
+		{`\`, `\`},
+		{`\a\b`, `ab`},
+		{`?`, `日`},
+		{`??`, `日`},
+		{`?本?`, `日本語`},
+		{`?`, "\xff"},
+		{"\xff*", "\xff\xfe"},
+		{"*\x80", "ǀ"},
+		{"a*\x80b", "aǀb"},
+	} {
+		if !globAgrees(tc.pattern, tc.str) {
+			t.Errorf("glob %q on %q: globPattern, path.Match and refGlob disagree", tc.pattern, tc.str)
+		}
+	}
+}
+
+func FuzzGlobPattern(f *testing.F) {
+	f.Add("a*b*c", "abxbc")
+	f.Add(`a\\*`, `a\b`)
+	f.Add("?*x", "日本x")
+	f.Fuzz(func(t *testing.T, pattern, str string) {
+		// refGlob takes time exponential in the number of *.
+		if strings.Count(pattern, "*") > 4 || len(pattern) > 16 || len(str) > 32 {
+			t.Skip()
+		}
+		if !globAgrees(pattern, str) {
+			t.Fatalf("glob %q on %q: globPattern, path.Match and refGlob disagree", pattern, str)
+		}
+	})
+}
+
+func TestGlobRegexpAgrees(t *testing.T) {
+	globs := []string{"*", "*.go", "a?c", "*_test.go", `\*.txt`, "?*", "a*b*c", "é?", `a\?b`, "[x]*"}
+	names := []string{"", "a", "abc", "aXc", "main.go", "main_test.go", "*.txt", "x.txt", "é", "éé", "a?b", "aab", "abbbc", "[x]y", "a\nc"}
+	for _, g := range globs {
+		re, err := compileGlob(g)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", g, err)
+		}
+		p, err := newGlobPattern(g)
+		if err != nil {
+			t.Fatalf("newGlobPattern(%q): %v", g, err)
+		}
+		for _, name := range names {
+			want := p.matches(name)
+			if got := re.MatchString(name); got != want {
+				t.Errorf("glob %q on %q: regexp %s says %v, glob says %v", g, name, re, got, want)
+			}
+		}
+	}
+	for _, g := range []string{"**", `a\`} {
+		if _, err := compileGlob(g); err == nil {
+			t.Errorf("compileGlob(%q) succeeded, want an error", g)
+		}
+	}
+}
+
+func TestGlobPaths(t *testing.T) {
+	for _, tc := range []struct {
+		glob, path string
+		want       bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/x/main.go", true},
+		{"main*", "cmd/main.go", true},
+		{"*", "a/b", true},
+		{"cmd/*/main.go", "cmd/x/main.go", true},
+		{"cmd/*/main.go", "cmd/x/y/main.go", false},
+		{"cmd/*/main.go", "src/cmd/x/main.go", false},
+		{"/cmd/*.go", "cmd/a.go", true},
+		{"cmd/?.go", "cmd/a.go", true},
+		{"c*d/a.go", "c/d/a.go", false},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/**/main.go", "cmd/x/y/main.go", true},
+		{"**/testdata/*", "a/b/testdata/x", true},
+		{"**/testdata/*", "testdata/x", true},
+		{"**/testdata/*", "testdata/x/y", false},
+		{"vendor/", "vendor/a/b.go", true},
+		{"vendor/", "src/vendor/a.go", false},
+		{"vendor/**", "vendor/a/b.go", true},
+	} {
+		re, err := compileGlob(tc.glob)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", tc.glob, err)
+		}
+		if got := re.MatchString(tc.path); got != tc.want {
+			t.Errorf("glob %q on %q: got %v, want %v (regexp %s)", tc.glob, tc.path, got, tc.want, re)
+		}
+	}
+	for _, g := range []string{"a/**b", `a/b\`} {
+		if _, err := compileGlob(g); err == nil {
+			t.Errorf("compileGlob(%q) succeeded, want an error", g)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"cmd/a/main.go", "cmd/b/main.go", "cmd/b/c/main.go", "main.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("needle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, err := search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "cmd/*/main.go"}, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range m {
+		got = append(got, globPath(dir, h.Path))
+	}
+	if fmt.Sprint(got) != "[cmd/a/main.go cmd/b/main.go]" {
+		t.Errorf("got hits %v, want [cmd/a/main.go cmd/b/main.go]", got)
+	}
+}
+
+func TestFoldMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, data string
+		want          string // the line matched, or "" if none
+	}{
+		{"hello", "say HeLLo", "say HeLLo"},
+		{"привет", "ПРИВЕТ мир", "ПРИВЕТ мир"},
+		{"ΣΟΦΙΑ", "η σοφία", ""}, // accents are not folded
+		{"ΣΟΦΊΑ", "η σοφία", "η σοφία"},
+		{"ς", "ΟΔΟΣ", "ΟΔΟΣ"},
+		{"kelvin", "Kelvin", "Kelvin"},
+		{"K", "ok", "ok"},
+		{"ſ", "S", "S"},
+		{"straße", "STRASSE", ""},
+		{"straße", "STRAẞE", "STRAẞE"},
+		{"ǆ", "ǅ and Ǆ", "ǅ and Ǆ"},
+		{"abc", "ab\xffc", ""},
+		{"\xff", "a\xffb", "a\xffb"},
+	} {
+		q := &query{pattern: tc.pattern, ignoreCase: true, lineNumbers: true}
+		_, lines := q.match("f.txt", []byte("-\n"+tc.data+"\n-"))
+		got := ""
+		if len(lines) > 0 {
+			got = lines[0].Text
+		}
+		if got != tc.want {
+			t.Errorf("-i %q in %q: matched %q, want %q", tc.pattern, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestASCIIFoldSafe(t *testing.T) {
+	for c := rune(0); c < utf8.RuneSelf; c++ {
+		outside := false
+		for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+			outside = outside || f >= utf8.RuneSelf
+		}
+		if outside != strings.ContainsRune("kKsS", c) {
+			t.Errorf("%q folds outside ASCII: %v", c, outside)
+		}
+	}
+	for _, tc := range []struct {
+		pattern, data string
+		want          bool
+	}{
+		{"needle", "needle", true},
+		{"abc", "äbc", true},
+		{"desk", "desk", true},
+		{"desk", "deſk", false},
+		{"K", "k", false},
+	} {
+		if got := asciiFoldSafe([]byte(tc.pattern), []byte(tc.data)); got != tc.want {
+			t.Errorf("asciiFoldSafe(%q, %q) = %v, want %v", tc.pattern, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "history")
+	for i := 0; i < 2*historyMax; i++ {
+		e := historyEntry{Flags: []string{"-n", "-timeout", fmt.Sprint(i)}, Args: []string{"needle", "."}, Hits: i}
+		if err := addHistory(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := readHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != historyMax || h[len(h)-1].Hits != 2*historyMax-1 {
+		t.Fatalf("got %d entries, the last with %d hits, want %d, the last with %d", len(h), h[len(h)-1].Hits, historyMax, 2*historyMax-1)
+	}
+	h[len(h)-2].Flags = append(h[len(h)-2].Flags, "--")
+	h[len(h)-2].Args[0] = "-needle"
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "[-n -timeout 199 -- needle .]"},
+		{[]string{"1"}, "[-n -timeout 199 -- needle .]"},
+		{[]string{"2", "-i"}, "[-n -timeout 198 -i -- -needle .]"},
+		{[]string{"-i", "-n=false"}, "[-n -timeout 199 -i -n=false -- needle .]"},
+		{[]string{"0"}, "error"},
+		{[]string{"101"}, "error"},
+	} {
+		_, args, err := rerunArgs(h, tc.args)
+		got := fmt.Sprint(args)
+		if err != nil {
+			got = "error"
+		}
+		if got != tc.want {
+			t.Errorf("rerun %v: got %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	e := historyEntry{Flags: []string{"-g", "*.go"}, Args: []string{"it's", "a b"}}
+	if got, want := e.command(), `rtgrep -g '*.go' 'it'\''s' 'a b'`; got != want {
+		t.Errorf("got command %s, want %s", got, want)
+	}
+}
+
+func TestEstimateTree(t *testing.T) {
+	// A tree three levels deep, each directory with ten subdirectories
+	// and five files of 1000 bytes, one of them a .log, is the same
+	// whichever way the probes go, so the estimate is exact.
+	readDir := func(dir string) ([]os.FileInfo, error) {
+		var list []os.FileInfo
+		if strings.Count(dir, "/") < 3 {
+			for i := 0; i < 10; i++ {
+				list = append(list, &traceInfo{FileName: fmt.Sprint("d", i), FileMode: os.ModeDir})
+			}
+		}
+		for i := 0; i < 4; i++ {
+			list = append(list, &traceInfo{FileName: fmt.Sprint("f", i, ".txt"), FileSize: 1000})
+		}
+		return append(list, &traceInfo{FileName: "f.log", FileSize: 1000}), nil
+	}
+	files, _ := compileGlob("*")
+	est := estimateTree([]string{"t"}, files, readDir, rand.New(rand.NewSource(1)), time.Time{})
+	if est.files != 5555 || est.bytes != 5555000 || est.exts[".log"] != 1111000 {
+		t.Errorf("got %v files, %v bytes, %v in .log, want 5555, 5555000, 1111000", est.files, est.bytes, est.exts[".log"])
+	}
+	files, _ = compileGlob("*.log")
+	est = estimateTree([]string{"t"}, files, readDir, rand.New(rand.NewSource(1)), time.Time{})
+	if est.files != 1111 {
+		t.Errorf("got %v files matching *.log, want 1111", est.files)
+	}
+
+	if w := est.warning(time.Second); w != "" {
+		t.Errorf("got warning %q for a small tree", w)
+	}
+	big := estimate{files: 1e7, bytes: 1e12, exts: map[string]float64{".o": 7e11, ".c": 2e11, "": 1e11}}
+	w := big.warning(2 * time.Second)
+	for _, want := range []string{"10.0M files", "931.3 GiB", "*.o (70%), *.c (20%), files without an extension (10%)"} {
+		if !strings.Contains(w, want) {
+			t.Errorf("warning %q does not mention %q", w, want)
+		}
+	}
+}
+
+func TestSinks(t *testing.T) {
+	for _, spec := range []string{"xml", "text:color=yes", "http", "http:batch=0,url=http://x", "json:file"} {
+		if _, err := parseSink(spec, false); err == nil {
+			t.Errorf("parseSink(%q) succeeded, want an error", spec)
+		}
+	}
+
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posts = append(posts, string(body))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	out := new(fanout)
+	for _, spec := range []string{
+		"text:file=" + filepath.Join(dir, "out,1.txt"),
+		"json:file=" + filepath.Join(dir, "out.ndjson"),
+		"http:batch=2,url=" + srv.URL + "/hits?a=1,2",
+	} {
+		s, err := parseSink(spec, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.add(spec, s)
+	}
+	m := []hit{{Path: "a", Lines: []line{{N: 1, Text: "x"}}}, {Path: "b", Binary: true}, {Path: "c", Lines: []line{{N: 2, Text: "y"}}}}
+	for _, h := range m {
+		out.found(h)
+	}
+	if err := out.finish(m, stats{Matched: 3, Duration: 1500 * time.Microsecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	text, _ := ioutil.ReadFile(filepath.Join(dir, "out,1.txt"))
+	if want := "a:1:x\nBinary file b matches\nc:2:y\n3 hits\n"; string(text) != want {
+		t.Errorf("text sink wrote %q, want %q", text, want)
+	}
+	ndjson, _ := ioutil.ReadFile(filepath.Join(dir, "out.ndjson"))
+	lines := strings.Split(strings.TrimSpace(string(ndjson)), "\n")
+	if len(lines) != 4 || lines[0] != `{"type":"hit","path":"a","lines":[{"n":1,"text":"x"}]}` || lines[1] != `{"type":"hit","path":"b","binary":true}` || !strings.HasPrefix(lines[3], `{"type":"stats","stats":{"walked":0,`) || !strings.HasSuffix(lines[3], `"durationMs":1.5}}`) {
+		t.Errorf("json sink wrote %q", ndjson)
+	}
+	var rec sinkStats
+	if err := json.Unmarshal([]byte(lines[3]), &rec); err != nil || rec.Stats.Matched != 3 || rec.Stats.Duration != 1500*time.Microsecond {
+		t.Errorf("stats read back as %+v, %v; want 3 matched in 1.5ms", rec.Stats, err)
+	}
+	if len(posts) != 2 || strings.Join(posts, "") != string(ndjson) || strings.Count(posts[0], "\n") != 2 {
+		t.Errorf("http sink posted %q, want the json sink's lines in two batches", posts)
+	}
+
+	bad := new(fanout)
+	s, _ := parseSink("http:url="+srv.URL+"x", true)
+	srv.Close()
+	bad.add("http", s)
+	if err := bad.finish(nil, stats{}); err == nil {
+		t.Errorf("http sink to a closed server succeeded")
+	}
+}
+
+func TestHTTPSinkSlow(t *testing.T) {
+	release := make(chan struct{})
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&posts, 1)
+	}))
+	defer srv.Close()
+	s := newHTTPSink(srv.URL, 1)
+	start := time.Now()
+	for i := 0; i < httpSinkQueue+10; i++ {
+		s.found(hit{Path: fmt.Sprint(i)})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("found took %v with the server stuck, want no waiting", d)
+	}
+	close(release)
+	err := s.finish(nil, stats{})
+	if err == nil || !strings.Contains(err.Error(), "dropped") {
+		t.Errorf("finish: got %v, want an error counting dropped hits", err)
+	}
+	if n := atomic.LoadInt32(&posts); n < httpSinkQueue {
+		t.Errorf("got %d posts, want the %d queued hits sent", n, httpSinkQueue)
+	}
+}
+
+func TestReadDisk(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "f")
+	if err := ioutil.WriteFile(name, []byte("needle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readDisk(name); string(data) != "needle" || err != nil {
+		t.Errorf("readDisk = %q, %v; want needle, nil", data, err)
+	}
+	if _, err := readDisk(name + "x"); !vanished(err) {
+		t.Errorf("readDisk of a missing file: %v", err)
+	}
+}
+
+func TestOwnFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "out.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("needle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := &query{pattern: "needle", filepattern: "*", own: newOwnFiles([]string{filepath.Join(dir, "out.txt")})}
+	m, st, err := search(context.Background(), []string{dir}, q, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || filepath.Base(m[0].Path) != "a.txt" || st.Ignored != 1 {
+		t.Errorf("got hits %v, %d ignored; want a.txt, 1 ignored", m, st.Ignored)
+	}
+
+	// Changes to own files leave cached listings alone.
+	c := &dirCache{dirs: make(map[string]*cachedDir), gens: make(map[string]uint64), own: make(map[string]bool)}
+	c.ignore([]string{filepath.Join(dir, "out.txt")})
+	c.dirs[dir] = new(cachedDir)
+	c.invalidate(dir, "out.txt")
+	if c.dirs[dir] == nil {
+		t.Errorf("a change to out.txt dropped the listing")
+	}
+	c.invalidate(dir, "a.txt")
+	if c.dirs[dir] != nil {
+		t.Errorf("a change to a.txt kept the listing")
+	}
+}
+
+func TestDef(t *testing.T) {
+	for _, tc := range []struct {
+		name, line string
+		want       bool
+	}{
+		{"a.go", "func parse(s string) error {", true},
+		{"a.go", "func (p *P) parse() {", true},
+		{"a.go", "type parse struct {", true},
+		{"a.go", "\terr := parse(s)", false},
+		{"a.go", "// parse returns", false},
+		{"a.py", "    def parse(self):", true},
+		{"a.py", "class parse:", true},
+		{"a.py", "parse = make_parser()", true},
+		{"a.py", "    x = parse(s)", false},
+		{"a.py", "parse == 1", false},
+		{"a.c", "static int parse(const char *s)", true},
+		{"a.c", "#define parse(s) x", true},
+		{"a.c", "\tn = parse(s);", false},
+		{"a.c", "int parse(const char *s);", false},
+		{"a.js", "export function parse(s) {", true},
+		{"a.js", "  async parse(s) {", true},
+		{"a.js", "const parse = (s) => s", true},
+		{"a.js", "  parse(s);", false},
+		{"a.sh", "parse() {", true},
+		{"a.sh", "parse \"$@\"", false},
+		{"a.rs", "pub fn parse(s: &str) {", true},
+		{"a.rb", "  def parse(s)", true},
+		{"a.txt", "def parse", false},
+	} {
+		i := strings.Index(tc.line, "parse")
+		if got := isDef(defTemplatesOf(tc.name), []byte(tc.line), i, i+len("parse")); got != tc.want {
+			t.Errorf("%s: isDef(%q) = %v, want %v", tc.name, tc.line, got, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"a.go":  "x := parse(s)\n",
+		"b.txt": "func parse\n",
+		"c.py":  "import parse\n\ndef parse():\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, err := search(context.Background(), []string{dir}, &query{pattern: "parse", filepattern: "*", def: true}, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range m {
+		got = append(got, fmt.Sprintf("%s:%v", filepath.Base(h.Path), h.Def))
+		if h.Lines != nil {
+			t.Errorf("%s: got lines without -n", h.Path)
+		}
+	}
+	if want := "[c.py:true a.go:false b.txt:false]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	const a, b = "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"
+	out := a + " 1 3 1\nauthor Ann\nauthor-mail <ann@x>\nauthor-time 1000000000\nauthor-tz +0200\nsummary x\nfilename f\n\tneedle\n" +
+		b + " 7 9 1\nauthor Bob\nauthor-time 1100000000\nauthor-tz -0500\nfilename f\n\tneedle again\n" +
+		a + " 2 12\n\tneedle once more\n"
+	blamed := parseBlame([]byte(out))
+	for n, want := range map[int]string{3: a[:8] + " Ann 2001-09-09T03:46:40+02:00", 9: b[:8] + " Bob 2004-11-09T06:33:20-05:00", 12: a[:8] + " Ann 2001-09-09T03:46:40+02:00"} {
+		bl := blamed[n]
+		if bl == nil {
+			t.Errorf("line %d not blamed", n)
+			continue
+		}
+		if got := fmt.Sprintf("%.8s %s %s", bl.Commit, bl.Author, bl.Date.Format(time.RFC3339)); got != want {
+			t.Errorf("line %d: got %s, want %s", n, got, want)
+		}
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=Ann", "-c", "user.email=ann@x"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	path := filepath.Join(dir, "f.txt")
+	git("init", "-q")
+	ioutil.WriteFile(path, []byte("a\nneedle\n"), 0644)
+	git("add", "f.txt")
+	git("commit", "-q", "-m", "x")
+	ioutil.WriteFile(path, []byte("a\nneedle\nneedle\n"), 0644)
+	m, _, err := search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "*.txt", lineNumbers: true, blame: true}, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].Lines) != 2 {
+		t.Fatalf("got hits %+v", m)
+	}
+	if bl := m[0].Lines[0].Blame; bl == nil || bl.Author != "Ann" {
+		t.Errorf("committed line blamed on %+v, want Ann", bl)
+	}
+	if bl := m[0].Lines[1].Blame; bl == nil || strings.Trim(bl.Commit, "0") != "" {
+		t.Errorf("uncommitted line blamed on %+v, want no commit", bl)
+	}
+}
+
+func TestExtSink(t *testing.T) {
+	for path, want := range map[string]string{
+		"a/b.go":          ".go",
+		"x.pb.go":         ".pb.go",
+		"jquery.min.js":   ".min.js",
+		"v1.2.tar.gz":     ".tar.gz",
+		"my.config.json":  ".json",
+		"Makefile":        "",
+		".bashrc":         "",
+		"dir.d/.env.prod": ".prod",
+	} {
+		if got := groupExt(path); got != want {
+			t.Errorf("groupExt(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	m := []hit{
+		{Path: "a.go", Lines: []line{{N: 1}, {N: 2}}},
+		{Path: "a.pb.go", Lines: []line{{N: 1}}},
+		{Path: "b.pb.go", Lines: []line{{N: 1}}},
+		{Path: "README"},
+	}
+	if err := (&extSink{w: nopCloser{&buf}}).finish(m, stats{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "  files   lines  extension\n" +
+		"      2       2  .pb.go\n" +
+		"      1       0  (none)\n" +
+		"      1       2  .go\n" +
+		"      4       4  total\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", &buf, want)
+	}
+}
+
+func TestWalkDeepTree(t *testing.T) {
+	dir := t.TempDir()
+	const depth = 1000
+	deep := filepath.Join(dir, strings.Repeat("d"+string(filepath.Separator), depth))
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Skip(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "d", "d", "a.txt"), filepath.Join(deep, "b.txt")} {
+		if err := ioutil.WriteFile(path, []byte("needle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, st, err := search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "*", maxDepth: 5}, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || filepath.Base(m[0].Path) != "a.txt" {
+		t.Errorf("with -max-depth 5, got hits %v, want a.txt only", m)
+	}
+	if want := filepath.Join(dir, strings.Repeat("d"+string(filepath.Separator), 6)); st.TooDeep != 1 || st.TooDeepPath != want {
+		t.Errorf("got %d too deep, first %q, want 1, %q", st.TooDeep, st.TooDeepPath, want)
+	}
+
+	m, st, err = search(context.Background(), []string{dir}, &query{pattern: "needle", filepattern: "*"}, walkDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || st.TooDeep != 0 {
+		t.Errorf("with no limit, got hits %v and %d too deep, want 2 hits", m, st.TooDeep)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	path, keyFile := filepath.Join(dir, "audit.log"), filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(n int) func() ([]hit, stats, error) {
+		return func() ([]hit, stats, error) {
+			// The search is recorded as started before it runs.
+			data, err := ioutil.ReadFile(path)
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			if err != nil || !bytes.Contains(lines[len(lines)-1], []byte(`"event":"start"`)) {
+				t.Errorf("search ran before its start was recorded: %s, %v", data, err)
+			}
+			return make([]hit, n), stats{}, nil
+		}
+	}
+	for i, pattern := range []string{"needle", "haystack", "pin"} {
+		// Reopen the log each time, to check that the chain goes on.
+		a, err := openAudit(path, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, _, err := a.search("0", &request{Pattern: pattern, Roots: []string{dir}}, run(i))
+		if err != nil || len(m) != i {
+			t.Fatalf("search %d: got %d hits, %v", i, len(m), err)
+		}
+	}
+	a, err := openAudit(path, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.refuse("0", &request{Pattern: "needle", Roots: []string{"/"}}, errors.New("/ is not below a tree this daemon searches"))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("needle")) {
+		t.Errorf("the log has the pattern itself:\n%s", data)
+	}
+	sum := sha256.Sum256([]byte("needle"))
+	if bytes.Contains(data, []byte(hex.EncodeToString(sum[:]))) {
+		t.Errorf("the log has the unkeyed digest of the pattern:\n%s", data)
+	}
+	var events []string
+	for _, l := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var e auditEntry
+		if err := json.Unmarshal(l, &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e.Event)
+	}
+	if want := []string{"start", "done", "start", "done", "start", "done", "refused"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+	if n, err := verifyAudit(bytes.NewReader(data), []byte("secret")); n != 7 || err != nil {
+		t.Errorf("verify: got %d entries, %v, want 7 and no error", n, err)
+	}
+	if _, err := verifyAudit(bytes.NewReader(data), []byte("guess")); err == nil {
+		t.Errorf("verify with the wrong key succeeded")
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	// The second search, with one hit, is done on line 4.
+	edited := bytes.Replace(data, []byte(`"hits":1`), []byte(`"hits":2`), 1)
+	dropped := append(append([]byte{}, lines[0]...), lines[2]...)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"edited", edited, 3},
+		{"dropped", dropped, 1},
+	} {
+		if n, err := verifyAudit(bytes.NewReader(tc.data), []byte("secret")); n != tc.want || err == nil {
+			t.Errorf("verify %s: got %d entries, %v, want a broken chain after %d", tc.name, n, err, tc.want)
+		}
+	}
+
+	// A search is not run if it cannot be recorded.
+	a = &auditLog{w: faultWriter{}}
+	ran := false
+	if _, _, err := a.search("0", &request{Pattern: "needle"}, func() ([]hit, stats, error) {
+		ran = true
+		return nil, stats{}, nil
+	}); err == nil || ran {
+		t.Errorf("unrecorded search: ran %v, got %v, want it refused", ran, err)
+	}
+}
+
+type faultWriter struct{}
+
+func (faultWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestEmptyPattern(t *testing.T) {
+	for _, r := range []request{
+		{FilePattern: "*"},
+		{FilePattern: "*", AllowEmpty: true, LineNumbers: true},
+		{FilePattern: "*", AllowEmpty: true, Hash: "sha256"},
+		{FilePattern: "*", JSONLField: "a="},
+		{FilePattern: "*", JSONLField: "a=", AllowEmpty: true},
+	} {
+		if _, err := r.query(); err == nil {
+			t.Errorf("query of %+v succeeded, want an error", r)
+		}
+	}
+	for _, r := range []request{
+		{FilePattern: "*", Entropy: 4.5},
+		{FilePattern: "*", JSONLField: "a=needle"},
+	} {
+		if q, err := r.query(); err != nil || q.list {
+			t.Errorf("query of %+v: got %v, list %v; want a search", r, err, q != nil && q.list)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := (&request{FilePattern: "*.txt", AllowEmpty: true}).query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unread := func(path string) ([]byte, error) {
+		t.Errorf("read %s", path)
+		return nil, os.ErrInvalid
+	}
+	m, st, err := newPipeline(q, walkDisk, unread).run(context.Background(), []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || filepath.Base(m[0].Path) != "a.txt" || filepath.Base(m[1].Path) != "b.txt" || st.Searched != 0 {
+		t.Errorf("got hits %v, %d searched, want a.txt and b.txt listed", m, st.Searched)
+	}
+}
+
+func TestMatchesEverything(t *testing.T) {
+	m := []hit{{Path: "a.go"}, {Path: "b.go"}, {Path: "c.txt"}}
+	for _, tc := range []struct {
+		searched, above int
+		summary         bool
+	}{
+		{3, 2, true},
+		{3, 3, false},
+		{3, 0, false},
+		{10, 2, false},
+		{0, 2, false}, // listed, not searched
+	} {
+		var b bytes.Buffer
+		s := &textSink{w: nopCloser{&b}, summarizeAbove: tc.above}
+		if err := s.finish(m, stats{Searched: tc.searched, Matched: len(m)}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(b.String(), "extension"); got != tc.summary {
+			t.Errorf("%d hits of %d searched, above %d: got %q, want a summary %v", len(m), tc.searched, tc.above, b.String(), tc.summary)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	for _, d := range []string{dir, other} {
+		if err := ioutil.WriteFile(filepath.Join(d, "a.txt"), []byte("needle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "rtgrep.sock")
+	t.Setenv("RTGREP_SOCKET", socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "b.txt"), []byte("needle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var audited bytes.Buffer
+	srv := &daemonServer{s: newSearcher(newDirCache(time.Second).walk), token: []byte("secret"), audit: &auditLog{w: &audited, key: []byte("key")}}
+	srv.allow.Set(dir)
+	srv.allow.Set("max-bytes=3," + sub)
+	t.Setenv("RTGREP_TOKEN", "secret")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	r := &request{Roots: []string{dir}, Pattern: "needle", FilePattern: "*", Timeout: time.Second}
+	m, st, err := searchDaemon(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0].Path != filepath.Join(dir, "a.txt") || st.Searched != 2 {
+		t.Errorf("got hits %v, %d searched, want %s and %s", m, st.Searched, filepath.Join(dir, "a.txt"), filepath.Join(sub, "b.txt"))
+	}
+	// The ceilings of the innermost tree apply.
+	r.Roots = []string{sub}
+	if m, st, err := searchDaemon(r); err != nil || len(m) != 0 || st.Truncated != "max-bytes" {
+		t.Errorf("search of %s with max-bytes=3: got hits %v, truncated %q, %v; want none, truncated by max-bytes", sub, m, st.Truncated, err)
+	}
+	r.Roots = []string{other}
+	if _, _, err := searchDaemon(r); err == nil || !strings.Contains(err.Error(), "not below") {
+		t.Errorf("search of %s outside -allow: got %v, want it refused", other, err)
+	}
+	// Pages of the hits.
+	ask := func(r *request) response {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var resp response
+		if err := json.NewEncoder(conn).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := ask(&request{Roots: []string{dir}, Pattern: "needle", FilePattern: "*", Timeout: time.Second, Token: "secret", Limit: 1})
+	if resp.Err != "" || resp.Total != 2 || len(resp.Hits) != 1 || resp.Hits[0].Path != filepath.Join(dir, "a.txt") || resp.Cursor == "" {
+		t.Errorf("first page, limit 1: got %+v; want %s of 2 hits, and a cursor", resp, filepath.Join(dir, "a.txt"))
+	}
+	cursor := resp.Cursor
+	resp = ask(&request{Cursor: cursor, Limit: 1, Token: "secret"})
+	if resp.Err != "" || resp.Total != 2 || len(resp.Hits) != 1 || resp.Hits[0].Path != filepath.Join(sub, "b.txt") || resp.Cursor != "" {
+		t.Errorf("second page, limit 1: got %+v; want %s of 2 hits, and no cursor", resp, filepath.Join(sub, "b.txt"))
+	}
+	if resp = ask(&request{Cursor: cursor, Token: "secret"}); resp.Err == "" {
+		t.Errorf("a cursor used again: got %+v, want an error", resp)
+	}
+
+	r.Roots = []string{dir}
+	for _, token := range []string{"", "wrong"} {
+		t.Setenv("RTGREP_TOKEN", token)
+		if _, _, err := searchDaemon(r); err == nil || !strings.Contains(err.Error(), "token") {
+			t.Errorf("search with token %q: got %v, want it refused", token, err)
+		}
+	}
+	// Refusals are audited too.
+	if n := strings.Count(audited.String(), `"event":"refused"`); n != 3 {
+		t.Errorf("got %d refusals audited, want 3:\n%s", n, audited.String())
+	}
+
+	// A daemon without -allow does not run git for its clients.
+	for _, allow := range []allowList{nil, srv.allow} {
+		client, conn := net.Pipe()
+		go (&daemonServer{s: srv.s, allow: allow}).serve(conn)
+		r := &request{Roots: []string{dir}, Pattern: "needle", FilePattern: "*", LineNumbers: true, Blame: true, Timeout: time.Second}
+		var resp response
+		if err := json.NewEncoder(client).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewDecoder(client).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		if refused := strings.Contains(resp.Err, "-allow"); refused != (allow == nil) {
+			t.Errorf("-blame with -allow %v: got %+v", allow, resp)
+		}
+	}
+
+	// Without $RTGREP_SOCKET, a socket in a directory others may enter
+	// is not used.
+	t.Setenv("RTGREP_SOCKET", "")
+	shared := t.TempDir()
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", shared)
+	if _, _, err := searchDaemon(r); err != errNoDaemon {
+		t.Errorf("search through a shared directory: got %v, want %v", err, errNoDaemon)
+	}
+	if err := privateDir(shared); err == nil {
+		t.Errorf("privateDir(%s) with mode 0777 succeeded", shared)
+	}
+	if err := privateDir(filepath.Join(shared, "private")); err != nil {
+		t.Errorf("privateDir of a new directory: %v", err)
+	}
+}
+
+func TestDaemonHangUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := ioutil.WriteFile(path, []byte("needle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The walk comes upon a.txt again and again, until the search is
+	// canceled.
+	walk := func(root string, fn walkFunc) error {
+		for {
+			if err := fn(path, info, nil); err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	srv := &daemonServer{s: newSearcher(walk)}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.serve(server)
+		close(done)
+	}()
+	if err := json.NewEncoder(client).Encode(&request{Roots: []string{filepath.Dir(path)}, Pattern: "needle", FilePattern: "*", Timeout: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the daemon kept searching after its client hung up")
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		dir      string
+		timeout  time.Duration
+		maxBytes int64
+		ok       bool
+	}{
+		{"/srv/src", "/srv/src", 0, 0, true},
+		{"timeout=10s,max-bytes=1k,/srv/src", "/srv/src", 10 * time.Second, 1024, true},
+		{"max-bytes=2M,/srv/a,b", "/srv/a,b", 0, 2 << 20, true},
+		{"x=1,/srv/src", "x=1,/srv/src", 0, 0, true},
+		{"timeout=-1s,/srv/src", "", 0, 0, false},
+		{"max-bytes=lots,/srv/src", "", 0, 0, false},
+	} {
+		var a allowList
+		err := a.Set(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("Set(%q): got %v", tc.s, err)
+			continue
+		}
+		if want := (allowedTree{resolvePath(tc.dir), tc.timeout, tc.maxBytes}); tc.ok && a[0] != want {
+			t.Errorf("Set(%q) = %+v, want %+v", tc.s, a[0], want)
+		}
+	}
+
+	var a allowList
+	a.Set("timeout=1m,/srv")
+	a.Set("timeout=10s,max-bytes=100,/srv/logs")
+	r := &request{Roots: []string{"/srv/src"}, Timeout: time.Hour}
+	a.limit(r)
+	if r.Timeout != time.Minute || r.MaxBytes != 0 {
+		t.Errorf("limits below /srv: got %v and %d bytes, want 1m and none", r.Timeout, r.MaxBytes)
+	}
+	r = &request{Roots: []string{"/srv/src", "/srv/logs/app"}, Timeout: time.Second, MaxBytes: 1000}
+	a.limit(r)
+	if r.Timeout != time.Second || r.MaxBytes != 100 {
+		t.Errorf("limits below /srv/logs: got %v and %d bytes, want 1s and 100", r.Timeout, r.MaxBytes)
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.log")
+	if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newDirCache(time.Hour)
+	if c.watch == nil {
+		t.Skip("no directory watcher on this platform")
+	}
+	// eventually waits for the cached listing of dir to satisfy ok, as
+	// it does once the watcher has reported the change.
+	eventually := func(what string, ok func([]os.FileInfo) bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			list, err := c.readDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok(list) {
+				return
+			}
+		}
+		t.Errorf("the cached listing never showed %s", what)
+	}
+	eventually("a.log", func(l []os.FileInfo) bool { return len(l) == 1 })
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	eventually("b.log created", func(l []os.FileInfo) bool { return len(l) == 2 })
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("appended"); err != nil {
+		t.Fatal(err)
+	}
+	// The file is still open, so only IN_MODIFY tells of the change.
+	eventually("a.log appended to", func(l []os.FileInfo) bool { return l[0].Size() == 9 })
+
+	// A listing read while its directory changes is not cached.
+	other := t.TempDir()
+	c.listDir = func(d string) ([]os.FileInfo, error) {
+		c.invalidate(d, "")
+		return ioutil.ReadDir(d)
+	}
+	if _, err := c.readDir(other); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	_, cached := c.dirs[other]
+	c.mu.Unlock()
+	if cached {
+		t.Errorf("a listing invalidated while it was read was cached")
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		sample, want string
+	}{
+		{"", "empty"},
+		{"plain text\n", "ascii"},
+		{"h\xc3\xa9llo", "utf-8"},
+		{"h\xe9llo", "8-bit (not utf-8)"},
+		{"\xef\xbb\xbfhi", "utf-8 bom"},
+		{"\xff\xfeh\x00i\x00", "utf-16le bom"},
+		{"\xfe\xff\x00h\x00i", "utf-16be bom"},
+		{"\xff\xfe\x00\x00h\x00\x00\x00", "utf-32le bom"},
+		{"h\x00e\x00l\x00l\x00o\x00", "utf-16le (no bom)"},
+		{"\x00h\x00e\x00l\x00l\x00o", "utf-16be (no bom)"},
+		{"\x7fELF\x02\x01\x01\x00\x00\x00", "binary"},
+		// A sample cut short in the middle of a rune.
+		{strings.Repeat("a", 10) + "\xe6\x97", "utf-8"},
+	} {
+		if got := detectEncoding([]byte(tc.sample)); got != tc.want {
+			t.Errorf("detectEncoding(%q) = %q, want %q", tc.sample, got, tc.want)
+		}
+	}
+}
+
+func TestDetectEncodings(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"a.txt": "ascii", "b.txt": "h\xc3\xa9", "c.go": "package c", "gone.txt": "x"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// gone.txt is removed after it is listed, and a directory vanishes
+	// before it is read.
+	walk := func(root string, fn walkFunc) error {
+		err := walkDisk(root, func(path string, info os.FileInfo, err error) error {
+			if filepath.Base(path) == "gone.txt" {
+				os.Remove(path)
+			}
+			return fn(path, info, err)
+		})
+		if err != nil {
+			return err
+		}
+		return fn(filepath.Join(root, "sub"), nil, &os.PathError{Op: "open", Path: "sub", Err: os.ErrNotExist})
+	}
+	counts, skipped, err := detectEncodings(context.Background(), []string{dir}, "*", walk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(counts); got != "map[.go:map[ascii:1] .txt:map[ascii:1 utf-8:1]]" || skipped != 2 {
+		t.Errorf("got %s, %d skipped; want .txt: ascii 1, utf-8 1, .go: ascii 1, and 2 skipped", got, skipped)
+	}
+	var b bytes.Buffer
+	printEncodings(&b, counts)
+	if want := ".go\tascii: 1\n.txt\tascii: 1, utf-8: 1\n"; b.String() != want {
+		t.Errorf("printEncodings wrote %q, want %q", b.String(), want)
+	}
+
+	if _, _, err := detectEncodings(context.Background(), []string{filepath.Join(dir, "nonexistent")}, "*", walkDisk); err == nil {
+		t.Errorf("detectEncodings of a missing root succeeded")
+	}
+}
+
+func TestGoScope(t *testing.T) {
+	const src = `package p
+
+import "needle/pkg"
+
+type T struct {
+	Needle int ` + "`json:\"needle\"`" + `
+}
+
+func needle() {
+	f := func() { _ = "needle" }
+}
+`
+	for _, tc := range []struct {
+		scope, name, data string
+		want              []string // the lines matched
+	}{
+		{"func", "p.go", src, []string{"\tf := func() { _ = \"needle\" }"}},
+		{"import", "p.go", src, []string{`import "needle/pkg"`}},
+		{"struct-tag", "p.go", src, []string{"\tNeedle int `json:\"needle\"`"}},
+		// Only .go files are parsed.
+		{"import", "p.txt", src, []string{`import "needle/pkg"`, "\tNeedle int `json:\"needle\"`", "func needle() {", "\tf := func() { _ = \"needle\" }"}},
+		// Files that do not parse are matched as plain text.
+		{"func", "bad.go", "needle {", []string{"needle {"}},
+		{"func", "big.go", "package p // needle" + strings.Repeat(" ", maxGoParseSize), []string{"package p // needle" + strings.Repeat(" ", maxGoParseSize)}},
+	} {
+		q := &query{pattern: "needle", ignoreCase: true, lineNumbers: true, goScope: tc.scope, clock: newVirtualClock(time.Time{})}
+		_, lines := q.match(tc.name, []byte(tc.data))
+		var got []string
+		for _, l := range lines {
+			got = append(got, l.Text)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-go-scope %s in %s: matched %q, want %q", tc.scope, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(time.Minute))
+	defer cancel()
+	for _, tc := range []struct {
+		searched int64
+		estimate float64
+		ctx      context.Context
+		want     string
+	}{
+		{0, 0, context.Background(), "status: in dir, 0 files searched, 10 bytes read, 2 hits, 10s elapsed\n"},
+		{0, 100, ctx, "status: in dir, 0 files searched, 10 bytes read, 2 hits, 10s elapsed, timeout in 50s\n"},
+		{20, 100, ctx, "status: in dir, 20 files searched, 10 bytes read, 2 hits, 10s elapsed, about 40s to go for an estimated 100 files, timeout in 50s\n"},
+		{120, 100, context.Background(), "status: in dir, 120 files searched, 10 bytes read, 2 hits, 10s elapsed, past the estimate of 100 files\n"},
+	} {
+		p := &progress{searched: tc.searched, bytesRead: 10, hits: 2, estimate: tc.estimate}
+		p.dir.Store("dir")
+		var b bytes.Buffer
+		p.print(&b, tc.ctx, start, start.Add(10*time.Second))
+		if b.String() != tc.want {
+			t.Errorf("got %q, want %q", b.String(), tc.want)
+		}
+	}
+
+	if statusSignal == nil {
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	p := &progress{searched: 3}
+	p.dir.Store("dir")
+	r, w := io.Pipe()
+	reportStatus(ctx, p, w)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(statusSignal); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "status: in dir, 3 files searched,") {
+		t.Errorf("status signal printed %q, %v", line, err)
+	}
+
+	// Once the search is done, the signal must not kill the process.
+	cancel()
+	for i := 0; i < 1000 && !signal.Ignored(statusSignal); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !signal.Ignored(statusSignal) {
+		t.Fatal("status signal not ignored after the search")
+	}
+	if err := self.Signal(statusSignal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdent(t *testing.T) {
+	for _, tc := range []struct {
+		name, data string
+		want       []string // the lines matched
+	}{
+		{"a.go", "err := f()\nerrs = nil\nmyerr = 1\nerr_ = 2\nerr2 = 3", []string{"err := f()"}},
+		{"a.go", "x(err)\n\"err\"\ne.err.x", []string{"x(err)", `"err"`, "e.err.x"}},
+		// A later whole occurrence on a line still matches.
+		{"a.go", "errs, err := f()", []string{"errs, err := f()"}},
+		{"a.go", "éerr\nerrñ\n·err", []string{"·err"}},
+		// $ is part of identifiers only in JavaScript and TypeScript.
+		{"a.js", "$err\nerr$\nerr", []string{"err"}},
+		{"a.sh", "$err\nerr$\nerr", []string{"$err", "err$", "err"}},
+	} {
+		q := &query{pattern: "err", ident: true, lineNumbers: true}
+		_, lines := q.match(tc.name, []byte(tc.data))
+		var got []string
+		for _, l := range lines {
+			got = append(got, l.Text)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-ident err in %s %q: matched %q, want %q", tc.name, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestTextKinds(t *testing.T) {
+	letters := map[textKind]byte{codeText: 'c', commentText: '/', stringText: 's'}
+	for _, tc := range []struct {
+		name, src string
+		want      string // c, / or s for every byte of src
+	}{
+		{"a.go", `a"b\"c"//d`, `cssssss///`},
+		{"a.go", "`x\ny`/*z*/w", "sssss/////c"},
+		// A single-line string ends at the end of the line.
+		{"a.go", "\"ab\nc", "ssscc"},
+		{"a.js", "/* a", "////"},
+		// # starts a shell comment only at the start of a word.
+		{"a.sh", "a#b #c", "cccc//"},
+		{"a.sh", `'a\'b`, "ssssc"},
+		{"a.py", `"""a"b"""c`, "sssssssssc"},
+	} {
+		var got []byte
+		for _, k := range syntaxOf(tc.name).kinds([]byte(tc.src)) {
+			got = append(got, letters[k])
+		}
+		if string(got) != tc.want {
+			t.Errorf("kinds of %s %q = %s, want %s", tc.name, tc.src, got, tc.want)
+		}
+	}
+
+	const src = "x = 'x'\n# x\ny = 1\n"
+	for _, tc := range []struct {
+		scope, name string
+		want        []string // the lines matched
+	}{
+		{"code", "a.py", []string{"x = 'x'"}},
+		{"strings", "a.py", []string{"x = 'x'"}},
+		{"comments", "a.py", []string{"# x"}},
+		// Files of unknown languages are matched throughout.
+		{"comments", "a.txt", []string{"x = 'x'", "# x"}},
+	} {
+		q := &query{pattern: "x", scope: textKinds[tc.scope], lineNumbers: true}
+		_, lines := q.match(tc.name, []byte(src))
+		var got []string
+		for _, l := range lines {
+			got = append(got, l.Text)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-scope %s in %s: matched %q, want %q", tc.scope, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExpandShort(t *testing.T) {
+	fs := flag.NewFlagSet("rtgrep", flag.ContinueOnError)
+	fs.Bool("i", false, "")
+	fs.Bool("n", false, "")
+	fs.String("g", "*", "")
+	fs.String("scope", "", "")
+	for _, tc := range []struct {
+		args, want []string
+	}{
+		{[]string{"-in", "hello", "."}, []string{"-i", "-n", "hello", "."}},
+		{[]string{"-ni", "-g", "*.go", "x"}, []string{"-n", "-i", "-g", "*.go", "x"}},
+		{[]string{"-scope", "code", "-in", "x"}, []string{"-scope", "code", "-i", "-n", "x"}},
+		// Not all boolean, or past the flags.
+		{[]string{"-ig", "x"}, []string{"-ig", "x"}},
+		{[]string{"x", "-in"}, []string{"x", "-in"}},
+		{[]string{"--", "-in"}, []string{"--", "-in"}},
+	} {
+		if got := expandShort(fs, tc.args); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expandShort(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestDedupeRoots(t *testing.T) {
+	dir := t.TempDir()
+	repo, other := filepath.Join(dir, "repo"), filepath.Join(dir, "other")
+	for _, d := range []string{filepath.Join(repo, "src"), other} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots := []string{filepath.Join(repo, "src"), repo, repo + string(filepath.Separator), other, filepath.Join(other, "..", "repo")}
+	if err := os.Symlink(filepath.Join(repo, "src"), filepath.Join(dir, "link")); err == nil {
+		roots = append(roots, filepath.Join(dir, "link"))
+	}
+	if got, want := dedupeRoots(roots), []string{repo, other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupeRoots(%q) = %q, want %q", roots, got, want)
+	}
+
+	// Hits reached by two paths are reported once.
+	if err := ioutil.WriteFile(filepath.Join(repo, "src", "a.txt"), []byte("needle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, st, err := newPipeline(&query{pattern: "needle", filepattern: "*"}, walkDisk, readDisk).run(context.Background(), []string{repo, filepath.Join(repo, "src")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || st.Duplicates != 1 {
+		t.Errorf("got hits %v and %d duplicates, want one hit and one duplicate", paths(m), st.Duplicates)
+	}
+}
+
+func TestRecordDelim(t *testing.T) {
+	for _, tc := range []struct {
+		delim, want string // want is "" for an error
+	}{
+		{"nul", "\x00"},
+		{"crlf", "\r\n"},
+		{`\x1e`, "\x1e"},
+		{"--", "--"},
+		{`"`, `"`},
+		{"", ""},
+		{`\q`, ""},
+	} {
+		d, err := parseDelim(tc.delim)
+		if string(d) != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("parseDelim(%q) = %q, %v, want %q", tc.delim, d, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		delim, data string
+		want        []line
+	}{
+		{"|", "a needle|b|c needle|", []line{{N: 1, Text: "a needle"}, {N: 3, Text: "c needle"}}},
+		{"crlf", "x\r\nneedle\r\n", []line{{N: 2, Text: "needle"}}},
+		// Newlines are part of records when they do not end them.
+		{"nul", "x\nneedle\x00y", []line{{N: 1, Text: "x\nneedle"}}},
+		{"--", "a-b--c needle--", []line{{N: 2, Text: "c needle"}}},
+	} {
+		q, err := (&request{Pattern: "needle", LineNumbers: true, RecordDelim: tc.delim}).query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, lines := q.match("f.log", []byte(tc.data))
+		if !reflect.DeepEqual(lines, tc.want) {
+			t.Errorf("-record-delim %q in %q: matched %+v, want %+v", tc.delim, tc.data, lines, tc.want)
+		}
+	}
+}
+
+func TestJSONLField(t *testing.T) {
+	for _, s := range []string{"msg", "=needle", "msg="} {
+		if _, err := parseJSONLField(s); err == nil {
+			t.Errorf("parseJSONLField(%q) succeeded", s)
+		}
+	}
+
+	const log = `{"level":"error","msg":"disk needle","req":{"ids":[1,"needle"]}}
+{"level":"info","msg":"needle"}
+not json, needle
+{"msg":{"a":"needle"}}
+`
+	for _, tc := range []struct {
+		field, name, data string
+		want              []int // the records matched
+	}{
+		{"msg=needle", "app.log", log, []int{1, 2, 4}},
+		{"level=error", "app.log", log, []int{1}},
+		{"req.ids.1=needle", "app.log", log, []int{1}},
+		{"req.ids.0=1", "app.log", log, []int{1}},
+		{"req.ids.2=needle", "app.log", log, nil},
+		{"msg.a=needle", "app.log", log, []int{4}},
+		// Files whose first record is not a JSON object are not JSON
+		// lines, unless their extension says they are.
+		{"msg=needle", "app.log", "x\n" + log, nil},
+		{"msg=needle", "app.jsonl", "x\n" + log, []int{2, 3, 5}},
+	} {
+		q, err := (&request{JSONLField: tc.field, LineNumbers: true}).query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, lines := q.match(tc.name, []byte(tc.data))
+		var got []int
+		for _, l := range lines {
+			got = append(got, l.N)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-jsonl-field %s in %s: matched records %v, want %v", tc.field, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	const csv = "name,email,note\nann,needle@x,ok\nbob,b@x,needle\n\"multi\nline\",needle,x\n"
+	for _, tc := range []struct {
+		columns, name, data string
+		want                []int // the rows matched, or lines outside CSV files
+	}{
+		{"email", "a.csv", csv, []int{2, 4}},
+		{"note", "a.csv", csv, []int{3}},
+		{"2", "a.csv", csv, []int{2, 4}},
+		{"name,note", "a.csv", csv, []int{3}},
+		{"missing", "a.csv", csv, nil},
+		// Given only by index, columns are matched in the first row too.
+		{"1", "a.csv", "needle,x\ny,needle\n", []int{1}},
+		{"b", "a.tsv", "a\tb\nneedle\tx\nx\tneedle\n", []int{3}},
+		// Other files are matched as plain text.
+		{"email", "a.txt", "x\na,needle\n", []int{2}},
+	} {
+		q, err := (&request{Pattern: "needle", Columns: tc.columns, LineNumbers: true}).query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, lines := q.match(tc.name, []byte(tc.data))
+		var got []int
+		for _, l := range lines {
+			got = append(got, l.N)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-column %s in %s: matched %v, want %v", tc.columns, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		s    string
+		want time.Time // zero for an error
+	}{
+		{"90m", now.Add(-90 * time.Minute)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-05-01 10:30", time.Date(2024, 5, 1, 10, 30, 0, 0, time.Local)},
+		{"2024-05-01T10:30:00Z", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"yesterday", time.Time{}},
+	} {
+		got, err := parseTimeFlag("since", tc.s, now)
+		if !got.Equal(tc.want) || (err == nil) == tc.want.IsZero() {
+			t.Errorf("parseTimeFlag(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+
+	const log = "2024-05-01 09:59:59 needle a\n" +
+		"2024-05-01 10:00:00 needle b\n" +
+		"2024-05-01 10:30:00.123 needle c\n" +
+		"2024-05-01 11:00:01 needle d\n" +
+		"no stamp, needle e\n"
+	for _, tc := range []struct {
+		since, until string
+		want         []int // the lines matched
+	}{
+		{"2024-05-01 10:00:00", "2024-05-01 11:00", []int{2, 3}},
+		{"2024-05-01 10:00:00", "", []int{2, 3, 4}},
+		{"", "2024-05-01 10:00:00", []int{1, 2}},
+	} {
+		r := &request{Pattern: "needle", LineNumbers: true, Since: tc.since, Until: tc.until, TimeLayout: "2006-01-02 15:04:05"}
+		q, err := r.query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, lines := q.match("app.log", []byte(log))
+		var got []int
+		for _, l := range lines {
+			got = append(got, l.N)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-since %q -until %q: matched %v, want %v", tc.since, tc.until, got, tc.want)
+		}
+	}
+
+	// Without a layout, -since skips files last modified before it.
+	fsys := fstest.MapFS{
+		"old.log": &fstest.MapFile{Data: []byte("needle"), ModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)},
+		"new.log": &fstest.MapFile{Data: []byte("needle"), ModTime: time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)},
+	}
+	q, err := (&request{Pattern: "needle", FilePattern: "*", Since: "2024-05-01"}).query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := searchFS(context.Background(), fsys, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths(m)) != "[new.log]" {
+		t.Errorf("-since 2024-05-01: got hits %v, want [new.log]", paths(m))
+	}
+}
+
+func TestContain(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "a.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := ioutil.WriteFile(f, []byte("needle"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip(err)
+	}
+	// The walk does not follow links, so have it come upon
+	// link/secret.txt as it would if link had been a directory when it
+	// was listed.
+	walk := func(root string, fn walkFunc) error {
+		if err := walkDisk(root, fn); err != nil {
+			return err
+		}
+		path := filepath.Join(root, "link", "secret.txt")
+		info, err := os.Stat(path)
+		return fn(path, info, err)
+	}
+	t.Chdir(dir)
+	for _, r := range []string{root, "root"} {
+		for _, contain := range []bool{false, true} {
+			q, err := (&request{Pattern: "needle", FilePattern: "*", Contain: contain}).query()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, st, err := newPipeline(q, walk, readDisk).run(context.Background(), []string{r})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, escaped := 2, 0
+			if contain {
+				want, escaped = 1, 1
+			}
+			if len(m) != want || st.Escaped != escaped {
+				t.Errorf("-contain=%v in %s: got hits %v and %d outside the root, want %d hits and %d", contain, r, paths(m), st.Escaped, want, escaped)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+)
+
+// match reports whether data, the content of the file named name, contains
+// q's pattern, or with -entropy a high-entropy string, and, if q asks for
+// line numbers or -def, returns the lines containing them.
+func (q *query) match(name string, data []byte) (bool, []line) {
+	if q.field != nil {
+		return q.matchJSONL(name, data)
+	}
+	if q.columns != nil {
+		if found, lines, ok := q.matchCSV(name, data); ok {
+			return found, lines
+		}
+	}
+	delim := q.delim
+	if delim == nil {
+		delim = []byte{'\n'}
+	}
+	haystack, needle := data, []byte(q.pattern)
+	var keys []rune
+	if q.ignoreCase {
+		if asciiFoldSafe(needle, data) {
+			// ASCII folding keeps every byte in place, so offsets
+			// into haystack are offsets into data as well.
+			haystack, needle = lowerASCII(data), lowerASCII(needle)
+		} else {
+			keys = foldKeys(needle)
+		}
+	}
+	// index returns the start and end of the first occurrence of the
+	// pattern in data at or after from, or -1, -1.
+	index := func(from int) (int, int) {
+		if keys != nil {
+			i, j := indexFold(data[from:], keys)
+			if i < 0 {
+				return -1, -1
+			}
+			return from + i, from + j
+		}
+		i := bytes.Index(haystack[from:], needle)
+		if i < 0 {
+			return -1, -1
+		}
+		return from + i, from + i + len(needle)
+	}
+	dollar := dollarIdents[filepath.Ext(name)]
+	syn := syntaxOf(name)
+	var kinds []textKind
+	var scopes [][2]int
+	goScope, parsed := q.goScope != "" && filepath.Ext(name) == ".go", false
+	findPattern := func(from int) (int, int) {
+		for from <= len(data) {
+			i, j := index(from)
+			if i < 0 {
+				return -1, -1
+			}
+			from = i + 1
+			if q.ident && !isIdentBoundary(data, i, j, dollar) {
+				continue
+			}
+			if q.scope != anyText && syn != nil {
+				if kinds == nil {
+					kinds = syn.kinds(data)
+				}
+				if !allKind(kinds[i:j], q.scope) {
+					continue
+				}
+			}
+			if goScope {
+				if !parsed {
+					clk := q.clock
+					if clk == nil {
+						clk = realClock{}
+					}
+					scopes, goScope = goScopeRanges(name, data, q.goScope, clk)
+					parsed = true
+					if !goScope {
+						return i, j
+					}
+				}
+				if !inRanges(scopes, i, j) {
+					continue
+				}
+			}
+			if q.timeLayout != "" && !q.inWindow(recordAt(data, i, delim)) {
+				continue
+			}
+			return i, j
+		}
+		return -1, -1
+	}
+	// find returns the start and end of the first match at or after from,
+	// or -1, -1 if there is none.
+	usePattern := q.pattern != "" || q.entropy == 0
+	var blobs [][2]int
+	if q.entropy > 0 {
+		blobs = entropySpans(data, q.entropy)
+		if q.timeLayout != "" {
+			var kept [][2]int
+			for _, b := range blobs {
+				if q.inWindow(recordAt(data, b[0], delim)) {
+					kept = append(kept, b)
+				}
+			}
+			blobs = kept
+		}
+	}
+	find := func(from int) (int, int) {
+		i, j := -1, -1
+		if usePattern {
+			i, j = findPattern(from)
+		}
+		for len(blobs) > 0 && blobs[0][0] < from {
+			blobs = blobs[1:]
+		}
+		if len(blobs) > 0 && (i < 0 || blobs[0][0] < i) {
+			i, j = blobs[0][0], blobs[0][1]
+		}
+		return i, j
+	}
+	if !q.lineNumbers && !q.def {
+		i, _ := find(0)
+		return i >= 0, nil
+	}
+	var defs []defTemplate
+	if q.def {
+		defs = defTemplatesOf(name)
+	}
+
+	// Lines are records ending in delim. A match spanning several
+	// records is reported as one line holding all of them.
+	var lines []line
+	n, start := 1, 0
+	for start < len(data) {
+		i, j := find(start)
+		if i < 0 {
+			break
+		}
+		bol := bytes.LastIndex(data[start:i], delim)
+		if bol < 0 {
+			bol = start
+		} else {
+			bol += start + len(delim)
+		}
+		eol := bytes.Index(data[j:], delim)
+		if eol < 0 {
+			eol = len(data)
+		} else {
+			eol += j
+		}
+		n += bytes.Count(data[start:bol], delim)
+		lines = append(lines, line{
+			N:    n,
+			Text: clipLine(data[bol:eol], i-bol, j-bol, q.maxLine),
+			Def:  defs != nil && isDef(defs, data[bol:eol], i-bol, j-bol),
+		})
+		n += bytes.Count(data[bol:eol], delim) + 1
+		start = eol + len(delim)
+	}
+	return len(lines) > 0, lines
+}
+
+// recordAt returns the record of data that contains offset i.
+func recordAt(data []byte, i int, delim []byte) []byte {
+	bol := bytes.LastIndex(data[:i], delim)
+	if bol < 0 {
+		bol = 0
+	} else {
+		bol += len(delim)
+	}
+	eol := bytes.Index(data[i:], delim)
+	if eol < 0 {
+		return data[bol:]
+	}
+	return data[bol : i+eol]
+}
+
+// clipLine returns line, or if max is set and line is longer, max bytes of
+// it around line[i:j], with … marking where it was cut.
+func clipLine(line []byte, i, j, max int) string {
+	if max <= 0 || len(line) <= max {
+		return string(line)
+	}
+	start := i - (max-(j-i))/2
+	if start < 0 || j-i > max {
+		start = i
+	}
+	end := start + max
+	if end > len(line) {
+		end = len(line)
+		start = end - max
+	}
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start++
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end--
+	}
+	s := string(line[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(line) {
+		s += "…"
+	}
+	return s
+}
+
+// hasLongLine reports whether data has a record, ending in delim or by
+// default in a newline, longer than max bytes.
+func hasLongLine(data, delim []byte, max int) bool {
+	if delim == nil {
+		delim = []byte{'\n'}
+	}
+	for len(data) > max {
+		n := max + len(delim)
+		if n > len(data) {
+			n = len(data)
+		}
+		i := bytes.Index(data[:n], delim)
+		if i < 0 {
+			return true
+		}
+		data = data[i+len(delim):]
+	}
+	return false
+}
+
+// allKind reports whether every one of kinds is k.
+func allKind(kinds []textKind, k textKind) bool {
+	for _, kk := range kinds {
+		if kk != k {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII returns a copy of b with ASCII letters mapped to lower case.
+func lowerASCII(b []byte) []byte {
+	l := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		l[i] = c
+	}
+	return l
+}
+
+// dollarIdents are the file extensions of languages that allow $ in
+// identifiers.
+var dollarIdents = map[string]bool{
+	".js":  true,
+	".jsx": true,
+	".mjs": true,
+	".cjs": true,
+	".ts":  true,
+	".tsx": true,
+}
+
+// isIdentBoundary reports whether data[start:end] is neither preceded nor
+// followed by an identifier character, so that it is a whole identifier.
+func isIdentBoundary(data []byte, start, end int, dollar bool) bool {
+	if r, size := utf8.DecodeLastRune(data[:start]); size > 0 && isIdentRune(r, dollar) {
+		return false
+	}
+	if r, size := utf8.DecodeRune(data[end:]); size > 0 && isIdentRune(r, dollar) {
+		return false
+	}
+	return true
+}
+
+func isIdentRune(r rune, dollar bool) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || dollar && r == '$'
+}
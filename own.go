@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ownFiles are the files rtgrep writes while it searches: its -sink files,
+// its -record trace, its history, and its standard output if that is a
+// file. Searches leave them out, so that rtgrep does not find its own
+// results as they are written, and a daemon's directory cache does not
+// drop listings because they changed.
+type ownFiles struct {
+	paths []string      // absolute
+	infos []os.FileInfo // of the paths that exist, and of standard output
+}
+
+// newOwnFiles returns the own files at paths, which are absolute.
+func newOwnFiles(paths []string) ownFiles {
+	o := ownFiles{paths: paths}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			o.infos = append(o.infos, info)
+		}
+	}
+	return o
+}
+
+// addStdout adds standard output, if it is a file.
+func (o *ownFiles) addStdout() {
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode().IsRegular() {
+		o.infos = append(o.infos, info)
+	}
+}
+
+// has reports whether info is of one of the own files.
+func (o ownFiles) has(info os.FileInfo) bool {
+	for _, own := range o.infos {
+		if os.SameFile(own, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownPaths returns the absolute paths of the files a search writes to
+// besides standard output: those of sinks, the trace, if any, and the
+// history, if it is on. If standard output is a file whose path can be
+// found, as on Linux, it is included too, for a daemon to leave out.
+func ownPaths(sinks sinkFlags, trace string) []string {
+	paths := sinks.files()
+	if trace != "" {
+		paths = append(paths, trace)
+	}
+	if h := historyPath(); h != "" {
+		paths = append(paths, h)
+	}
+	if out, err := os.Stdout.Stat(); err == nil && out.Mode().IsRegular() {
+		if path, err := os.Readlink("/proc/self/fd/1"); err == nil {
+			if info, err := os.Stat(path); err == nil && os.SameFile(info, out) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	var abs []string
+	for _, path := range paths {
+		if p, err := filepath.Abs(path); err == nil {
+			abs = append(abs, p)
+		}
+	}
+	return abs
+}
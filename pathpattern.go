@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// File name patterns are globs, but every filter on paths matches with
+// regular expressions, so that globs and regular expressions given for
+// paths mean the same and are compiled and cached alike.
+
+// globRegexp returns the regular expression, anchored at both ends, that
+// matches the paths below a root, with slashes between components, that
+// the glob pattern g matches: * any run of characters and ? any one
+// character within a component, with backslash escaping the character after
+// it. A pattern without a slash matches files by name, at any depth. One
+// with a slash, as in cmd/*/main.go, is matched from the root down a
+// component at a time, as in .gitignore: a leading slash is dropped, a
+// component ** matches any number of components, and a trailing slash
+// matches everything below.
+func globRegexp(g string) (string, error) {
+	parts := []string{g}
+	if strings.Contains(g, "/") {
+		parts = strings.Split(strings.TrimPrefix(g, "/"), "/")
+		if parts[len(parts)-1] == "" {
+			parts[len(parts)-1] = "**"
+		}
+	}
+	// Reject what newGlobPattern rejects, so that both agree on which
+	// patterns are valid.
+	for _, part := range parts {
+		if part == "**" && len(parts) > 1 {
+			continue
+		}
+		if _, err := newGlobPattern(part); err != nil {
+			return "", err
+		}
+	}
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	if len(parts) == 1 {
+		b.WriteString(`(?:.*/)?`)
+	}
+	lit := func(s string) { b.WriteString(regexp.QuoteMeta(s)) }
+	for k, part := range parts {
+		last := k == len(parts)-1
+		if part == "**" {
+			if last {
+				b.WriteString(`.*`)
+			} else {
+				b.WriteString(`(?:.*/)?`)
+			}
+			continue
+		}
+		for i := 0; i < len(part); i++ {
+			switch c := part[i]; c {
+			case '\\':
+				i++
+				lit(part[i : i+1])
+			case '*':
+				b.WriteString(`[^/]*`)
+			case '?':
+				b.WriteString(`[^/]`)
+			default:
+				lit(part[i : i+1])
+			}
+		}
+		if !last {
+			b.WriteByte('/')
+		}
+	}
+	b.WriteString(`)$`)
+	return b.String(), nil
+}
+
+// globPath returns path, found by walking root, as globRegexp's patterns
+// match it: below root, with slashes between components. A root that is
+// not a directory is matched by its name.
+func globPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// compileGlob returns g compiled to a regular expression.
+func compileGlob(g string) (*regexp.Regexp, error) {
+	expr, err := globRegexp(g)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(expr)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// -read-profile tunes how files are read by their type and size, for trees
+// mixing small source files with large logs. The first profile a file fits
+// says how it is read; files fitting none are read whole, as ever. A
+// profile may cap how many of its files are read at once, readers=1
+// reading them one after another, as suits a disk that seeks, and may read
+// and match its files a chunk at a time rather than whole, so that a large
+// log takes a chunk of memory, and of -max-mem, rather than its size, and a
+// search only for the files with matches stops reading one at its first.
+//
+// A chunk ends after the last line end, or -record-delim, in it, and grows
+// to hold a line longer than itself. Matching a chunk at a time needs
+// matches to lie within lines, so files of a chunked profile are read whole
+// anyway by searches needing more of a file at once: -scope, -go-scope,
+// -jsonl-field, -column, -blame, and a pattern holding a line end. A read
+// failing in the middle of a file is not retried.
+
+// minChunk is the smallest chunk a profile may read, enough for the binary
+// check to see as much of a file as when reading it whole.
+const minChunk = binarySample
+
+// A readProfile says how the files it fits are read: those with one of its
+// extensions, if it lists any, at least minSize bytes long.
+type readProfile struct {
+	exts    []string
+	minSize int64
+	chunk   int64 // if set, files are read and matched this many bytes at a time
+	readers int   // if set, at most this many files are read at once
+}
+
+// profileFlags is the flag.Value of -read-profile, which can be given
+// several times.
+type profileFlags []string
+
+func (f *profileFlags) String() string { return strings.Join(*f, " ") }
+
+func (f *profileFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// parseReadProfile returns the profile spec describes, in comma-separated
+// key=value options: ext=.log|.txt and min-size=64M pick the files, and
+// chunk=4M and readers=1 say how they are read.
+func parseReadProfile(spec string) (readProfile, error) {
+	var rp readProfile
+	for _, kv := range strings.Split(spec, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return rp, fmt.Errorf("bad -read-profile %q: want key=value, not %q", spec, kv)
+		}
+		key, value := kv[:i], kv[i+1:]
+		var err error
+		switch key {
+		case "ext":
+			rp.exts = strings.Split(value, "|")
+			for _, ext := range rp.exts {
+				if !strings.HasPrefix(ext, ".") {
+					err = fmt.Errorf("%q does not start with a dot", ext)
+				}
+			}
+		case "min-size":
+			rp.minSize, err = parseSize(value)
+		case "chunk":
+			if rp.chunk, err = parseSize(value); err == nil && rp.chunk < minChunk {
+				err = fmt.Errorf("%q is less than %d bytes", value, minChunk)
+			}
+		case "readers":
+			if rp.readers, err = strconv.Atoi(value); err == nil && rp.readers <= 0 {
+				err = fmt.Errorf("%q is not a positive number", value)
+			}
+		default:
+			return rp, fmt.Errorf("bad -read-profile %q: unknown option %q", spec, key)
+		}
+		if err != nil {
+			return rp, fmt.Errorf("bad %s in -read-profile %q: %v", key, spec, err)
+		}
+	}
+	if rp.chunk == 0 && rp.readers == 0 {
+		return rp, fmt.Errorf("bad -read-profile %q: it sets neither chunk nor readers", spec)
+	}
+	return rp, nil
+}
+
+// fits reports whether the file at path, size bytes long, fits rp.
+func (rp *readProfile) fits(path string, size int64) bool {
+	if size < rp.minSize {
+		return false
+	}
+	for _, ext := range rp.exts {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return len(rp.exts) == 0
+}
+
+// profileOf returns the index of the first of q's profiles the file at
+// path, size bytes long, fits, or -1 if it fits none.
+func (q *query) profileOf(path string, size int64) int {
+	for i := range q.profiles {
+		if q.profiles[i].fits(path, size) {
+			return i
+		}
+	}
+	return -1
+}
+
+// chunkable reports whether q can match a file a chunk at a time, every
+// match lying within a line.
+func (q *query) chunkable() bool {
+	delim := q.delim
+	if delim == nil {
+		delim = []byte{'\n'}
+	}
+	return q.scope == anyText && q.goScope == "" && q.field == nil && q.columns == nil && !q.blame &&
+		!bytes.Contains([]byte(q.pattern), delim)
+}
+
+// chunk returns how many bytes at a time the file at path, size bytes
+// long, is read, by its profile i, or 0 if it is read whole.
+func (p *pipeline) chunk(i int, size int64) int64 {
+	if i < 0 || p.open == nil || !p.q.chunkable() || p.q.list {
+		return 0
+	}
+	if c := p.q.profiles[i].chunk; c < size {
+		return c
+	}
+	return 0
+}
+
+// fitsMem reports whether the file at path, size bytes long, is read a
+// chunk at a time that fits in q.maxMem, though the file does not.
+func (p *pipeline) fitsMem(path string, size int64) bool {
+	c := p.chunk(p.q.profileOf(path, size), size)
+	return c > 0 && c <= p.q.maxMem
+}
+
+// matchProfiled is matchFile, or with a chunk matchChunks, once one of the
+// readers of profile i, if it caps them, is free.
+func (p *pipeline) matchProfiled(ctx context.Context, path string, i int, chunk int64) (hit, bool, error) {
+	if i >= 0 && p.readers[i] != nil && !p.q.list {
+		select {
+		case p.readers[i] <- struct{}{}:
+			defer func() { <-p.readers[i] }()
+		case <-ctx.Done():
+			return hit{}, false, ctx.Err()
+		}
+	}
+	if chunk > 0 {
+		return p.matchChunks(ctx, path, chunk)
+	}
+	return p.matchFile(ctx, path)
+}
+
+// matchChunks is matchFile for a file read and matched chunk bytes at a
+// time, holding only a chunk, and the start of the line it ends in, in
+// memory. It stops reading at the first match if that is all q asks for.
+func (p *pipeline) matchChunks(ctx context.Context, path string, chunk int64) (h hit, ok bool, err error) {
+	q := p.q
+	f, err := p.open(path)
+	if err != nil {
+		return hit{}, false, err
+	}
+	defer f.Close()
+	stater, _ := f.(interface{ Stat() (os.FileInfo, error) })
+	var before os.FileInfo
+	if stater != nil {
+		if before, err = stater.Stat(); err != nil {
+			return hit{}, false, err
+		}
+	}
+	delim := q.delim
+	if delim == nil {
+		delim = []byte{'\n'}
+	}
+	var d hash.Hash
+	if q.hash != "" {
+		d = hashes[q.hash]()
+	}
+
+	// buf holds the chunk read, after what was left of the last one.
+	var buf []byte
+	lines := 0 // before buf
+	first, binary := true, false
+	for {
+		if err := ctx.Err(); err != nil {
+			return hit{}, false, err
+		}
+		n := len(buf)
+		if int64(cap(buf)-n) < chunk {
+			grown := make([]byte, n, int64(n)+chunk)
+			copy(grown, buf)
+			buf = grown
+		}
+		m, err := io.ReadFull(f, buf[n:int64(n)+chunk])
+		buf = buf[:n+m]
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return hit{}, false, err
+		}
+		atomic.AddInt64(&p.progress.bytesRead, int64(m))
+		if d != nil {
+			d.Write(buf[n:])
+		}
+		cut := len(buf)
+		if !eof {
+			i := bytes.LastIndex(buf, delim)
+			if i < 0 {
+				// In a line longer than the chunk.
+				continue
+			}
+			cut = i + len(delim)
+		}
+		data := buf[:cut]
+		if q.skipLong && hasLongLine(data, q.delim, q.maxLine) {
+			return hit{}, false, errLongLines
+		}
+		if first {
+			first = false
+			binary = q.binaryFiles != "text" && isBinary(data, q.delim)
+			if binary && q.binaryFiles == "without-match" {
+				return hit{}, false, errBinary
+			}
+		}
+		if found, ls := q.match(path, data); found {
+			ok = true
+			for i := range ls {
+				ls[i].N += lines
+			}
+			h.Lines = append(h.Lines, ls...)
+		}
+		lines += bytes.Count(data, delim)
+		buf = append(buf[:0], buf[cut:]...)
+		if eof || ok && d == nil && (binary || !q.lineNumbers && !q.def) {
+			break
+		}
+	}
+	atomic.AddInt64(&p.progress.searched, 1)
+	if !ok {
+		return hit{}, false, nil
+	}
+	h.Path = path
+	if stater != nil {
+		if after, err := stater.Stat(); err == nil && (after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())) {
+			atomic.AddInt64(&p.changed, 1)
+			h.Changed = true
+		}
+	}
+	q.settle(&h, binary)
+	if d != nil {
+		h.Sum, h.Hash = hex.EncodeToString(d.Sum(nil)), q.hash
+	}
+	return h, true, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcSearchFailed   = -32000
+	rpcCanceled       = -32800
+)
+
+// An rpcRequest is a JSON-RPC request or notification read from the client.
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// An rpcMessage is a response or notification sent to the client.
+type rpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcHit is the params of a "hit" notification.
+type rpcHit struct {
+	ID json.RawMessage `json:"id"`
+	hit
+}
+
+// rpcProgress is the params of a "progress" notification.
+type rpcProgress struct {
+	ID        json.RawMessage `json:"id"`
+	Dir       string          `json:"dir"`
+	Searched  int64           `json:"searched"`
+	BytesRead int64           `json:"bytesRead"`
+	Hits      int64           `json:"hits"`
+}
+
+// rpcServer answers the requests of one client of rtgrep rpc.
+type rpcServer struct {
+	s        *searcher
+	interval time.Duration
+	audit    *auditLog
+	uid      string // of the client, for audit
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// rpc runs rtgrep rpc: it reads JSON-RPC 2.0 requests from stdin and writes
+// responses and notifications to stdout, so that an editor can keep one
+// rtgrep running and search as the user types.
+//
+// The methods are "search", whose params are those of a daemon request and
+// whose result is the search's stats, and "cancel", whose params are
+// {"id": id} of a running search. While a search runs it sends "hit"
+// notifications with each hit and "progress" notifications every
+// -progress, both carrying the id of the search.
+func rpc(args []string) {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	interval := fs.Duration("progress", 500*time.Millisecond, "how often to send progress notifications while a search runs")
+	revalidate := fs.Duration("revalidate", 5*time.Second, "how often to check cached directories that cannot be watched for changes")
+	openAudit := auditFlags(fs)
+	fs.Parse(args)
+
+	c := newDirCache(*revalidate)
+	srv := &rpcServer{
+		s:        newSearcher(c.walk),
+		interval: *interval,
+		audit:    openAudit(),
+		uid:      selfUID(),
+		enc:      json.NewEncoder(os.Stdout),
+		running:  make(map[string]context.CancelFunc),
+	}
+	srv.s.ignore = c.ignore
+	srv.serve(os.Stdin)
+}
+
+// serve answers the requests read from r until it ends, then waits for the
+// searches still running to finish.
+func (srv *rpcServer) serve(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				srv.send(rpcMessage{Error: &rpcError{rpcParseError, err.Error()}})
+			}
+			break
+		}
+		switch req.Method {
+		case "search":
+			srv.search(req)
+		case "cancel":
+			var p struct{ ID json.RawMessage }
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				srv.reply(req, nil, &rpcError{rpcInvalidParams, err.Error()})
+				continue
+			}
+			srv.mu.Lock()
+			cancel, ok := srv.running[string(p.ID)]
+			srv.mu.Unlock()
+			if ok {
+				cancel()
+			}
+			srv.reply(req, ok, nil)
+		default:
+			srv.reply(req, nil, &rpcError{rpcMethodNotFound, "unknown method " + req.Method})
+		}
+	}
+	srv.wg.Wait()
+}
+
+// search starts the search asked for by req.
+func (srv *rpcServer) search(req rpcRequest) {
+	var r request
+	if err := json.Unmarshal(req.Params, &r); err != nil {
+		srv.reply(req, nil, &rpcError{rpcInvalidParams, err.Error()})
+		return
+	}
+	if len(r.Roots) == 0 {
+		r.Roots = []string{"."}
+	}
+	if r.FilePattern == "" {
+		r.FilePattern = "*"
+	}
+	q, err := r.query()
+	if err != nil {
+		srv.audit.refuse(srv.uid, &r, err)
+		srv.reply(req, nil, &rpcError{rpcInvalidParams, err.Error()})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.Timeout > 0 {
+		ctx, cancel = srv.s.clock.WithTimeout(context.Background(), r.Timeout)
+	}
+	id := string(req.ID)
+	srv.mu.Lock()
+	if _, dup := srv.running[id]; dup {
+		srv.mu.Unlock()
+		cancel()
+		srv.reply(req, nil, &rpcError{rpcInvalidParams, "a search with id " + id + " is running"})
+		return
+	}
+	srv.running[id] = cancel
+	srv.mu.Unlock()
+
+	q.progress = new(progress)
+	q.onHit = func(h hit) {
+		srv.send(rpcMessage{Method: "hit", Params: rpcHit{req.ID, h}})
+	}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		done := make(chan struct{})
+		go srv.report(req.ID, q.progress, done)
+		roots := dedupeRoots(r.Roots)
+		_, st, err := srv.audit.search(srv.uid, &r, func() ([]hit, stats, error) {
+			return srv.s.search(ctx, roots, q)
+		})
+		close(done)
+		srv.mu.Lock()
+		delete(srv.running, id)
+		srv.mu.Unlock()
+		cancel()
+		switch {
+		case err == context.Canceled:
+			srv.reply(req, nil, &rpcError{rpcCanceled, "search canceled"})
+		case err != nil:
+			srv.reply(req, nil, &rpcError{rpcSearchFailed, err.Error()})
+		default:
+			srv.reply(req, st, nil)
+		}
+	}()
+}
+
+// report sends progress notifications for the search with the given id
+// until done is closed.
+func (srv *rpcServer) report(id json.RawMessage, p *progress, done <-chan struct{}) {
+	t := time.NewTicker(srv.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			dir, _ := p.dir.Load().(string)
+			srv.send(rpcMessage{Method: "progress", Params: rpcProgress{
+				ID:        id,
+				Dir:       dir,
+				Searched:  atomic.LoadInt64(&p.searched),
+				BytesRead: atomic.LoadInt64(&p.bytesRead),
+				Hits:      atomic.LoadInt64(&p.hits),
+			}})
+		case <-done:
+			return
+		}
+	}
+}
+
+// reply answers req, unless it is a notification.
+func (srv *rpcServer) reply(req rpcRequest, result interface{}, err *rpcError) {
+	if req.ID == nil {
+		return
+	}
+	srv.send(rpcMessage{ID: req.ID, Result: result, Error: err})
+}
+
+func (srv *rpcServer) send(m rpcMessage) {
+	m.Version = "2.0"
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err := srv.enc.Encode(&m); err != nil {
+		log.Print(err)
+	}
+}
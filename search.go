@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// A candidate is a file the walk found that is to be searched.
+type candidate struct {
+	path string
+	info os.FileInfo
+}
+
+// A walker calls fn for root and every file and directory below it, in
+// lexical order, and stops at the first error fn returns, except that
+// filepath.SkipDir returned for a directory skips what is below it. If a
+// file or directory cannot be read, fn is called with the error instead,
+// and info may be nil. A walker may leave out directories, but not their
+// contents.
+type walker func(root string, fn walkFunc) error
+
+type walkFunc func(path string, info os.FileInfo, err error) error
+
+// walkDisk is the walker reading directories straight from disk.
+func walkDisk(root string, fn walkFunc) error {
+	return walkTree(root, ioutil.ReadDir, fn)
+}
+
+// walkTree walks the tree at root as a walker, listing directories with
+// readDir, which returns their entries sorted by name. It keeps the entries
+// still to be walked on a stack of its own rather than recursing, so that
+// no tree is too deep for it.
+func walkTree(root string, readDir func(dir string) ([]os.FileInfo, error), fn walkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	type entry struct {
+		path string
+		info os.FileInfo
+	}
+	stack := []entry{{root, info}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		err := fn(e.path, e.info, nil)
+		if err == filepath.SkipDir && e.info.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !e.info.IsDir() {
+			continue
+		}
+		list, err := readDir(e.path)
+		if err != nil {
+			if err := fn(e.path, e.info, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		for i := len(list) - 1; i >= 0; i-- {
+			stack = append(stack, entry{filepath.Join(e.path, list[i].Name()), list[i]})
+		}
+	}
+	return nil
+}
+
+// errChanged is returned by readDisk, along with what it read, for files
+// that changed while they were read.
+var errChanged = errors.New("file changed while it was read")
+
+// readDisk reads the file at path from disk, as ioutil.ReadFile does, and
+// returns what it read with errChanged if the file's size or modification
+// time changed between opening and closing it, as when it is being written
+// to.
+func readDisk(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return data, errChanged
+	}
+	return data, nil
+}
+
+// vanished reports whether err means that a file or directory disappeared
+// after it was listed, as happens all the time in busy build directories.
+func vanished(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || isStale(err)
+}
+
+// errLongLines is returned by matchFile for files skipped because of
+// -skip-long-lines.
+var errLongLines = errors.New("line longer than -max-line-length")
+
+// errBinary is returned by matchFile for binary files skipped because of
+// -binary-files without-match.
+var errBinary = errors.New("binary file")
+
+// binarySample is how much of the start of a file isBinary looks at.
+const binarySample = 8 << 10
+
+// isBinary reports whether data looks like the content of a binary file:
+// whether it has a NUL byte near the start, as grep decides. If records
+// are delimited by delim, and that has a NUL, as with -record-delim nul,
+// NUL bytes are expected, and no file looks binary.
+func isBinary(data, delim []byte) bool {
+	if bytes.IndexByte(delim, 0) >= 0 {
+		return false
+	}
+	if len(data) > binarySample {
+		data = data[:binarySample]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// openDisk opens the file at path on disk, for reading a chunk at a time.
+func openDisk(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// search looks for q in the files below roots until ctx is done, and
+// returns the hits, sorted by path, and how the search went. Running into
+// the deadline or q's other limits is not an error: the hits found so far
+// are returned, and the stats tell why the search stopped early.
+func search(ctx context.Context, roots []string, q *query, walk walker) ([]hit, stats, error) {
+	p := newPipeline(q, walk, readDisk)
+	p.open = openDisk
+	return p.run(ctx, roots)
+}
+
+// A pipeline runs one search in three stages connected by channels: walk
+// lists the candidate files, read reads and matches them, and collect
+// gathers the hits.
+type pipeline struct {
+	q        *query
+	walker   walker
+	readFile func(path string) ([]byte, error)
+	open     func(path string) (io.ReadCloser, error) // nil if files are only read whole
+	files    *regexp.Regexp                           // nil if the file pattern is invalid
+	progress *progress
+	mem      *semaphore.Weighted // nil unless q.maxMem is set
+	blamer   *blamer             // nil unless q.blame is set
+	readers  []chan struct{}     // per profile of q, nil unless it caps its readers
+	clock    clock
+
+	// st, scheduled and scheduledBytes are counted by walk, spawned by
+	// read, and the rest by read's goroutines.
+	st                      stats
+	scheduled, spawned      int
+	scheduledBytes          int64
+	gone, denied, longLines int64
+	binary, changed         int64
+	retried, ioErrors       int64
+}
+
+// newPipeline returns a pipeline for q that lists files with walk and
+// reads them with readFile.
+func newPipeline(q *query, walk walker, readFile func(path string) ([]byte, error)) *pipeline {
+	p := &pipeline{q: q, walker: walk, readFile: readFile, progress: q.progress, files: q.files, clock: realClock{}}
+	if p.files == nil {
+		p.files, _ = compileGlob(q.filepattern)
+	}
+	if p.progress == nil {
+		p.progress = new(progress)
+	}
+	if q.blame {
+		p.blamer = newBlamer()
+	}
+	// mem holds a credit for every byte of file content in memory, so
+	// that readers wait for others to finish rather than exceed q.maxMem.
+	if q.maxMem > 0 {
+		p.mem = semaphore.NewWeighted(q.maxMem)
+	}
+	p.readers = make([]chan struct{}, len(q.profiles))
+	for i, rp := range q.profiles {
+		if rp.readers > 0 {
+			p.readers[i] = make(chan struct{}, rp.readers)
+		}
+	}
+	return p
+}
+
+// run runs the pipeline on roots, as search.
+func (p *pipeline) run(ctx context.Context, roots []string) ([]hit, stats, error) {
+	start := p.clock.Now()
+	p.q.clock = p.clock
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// quiet fires once no hit has arrived for q.untilStable, and cancels the
+	// pipeline the same way the deadline would.
+	var quiet timer
+	var stable int32
+	if p.q.untilStable > 0 {
+		quiet = p.clock.AfterFunc(p.q.untilStable, func() {
+			atomic.StoreInt32(&stable, 1)
+			cancel()
+		})
+		defer quiet.Stop()
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	paths := make(chan candidate, 100)
+	g.Go(func() error {
+		defer close(paths)
+		return p.walk(ctx, roots, paths)
+	})
+	// Readers are started apart from collect, so that hits are seen as
+	// they are found.
+	c := make(chan hit, 100)
+	go func() {
+		p.read(ctx, g, paths, c)
+		g.Wait()
+		close(c)
+	}()
+	m := p.collect(c, func() {
+		if quiet != nil {
+			quiet.Reset(p.q.untilStable)
+		}
+	})
+	err := g.Wait()
+
+	st := p.st
+	st.Searched = int(atomic.LoadInt64(&p.progress.searched))
+	st.Vanished += int(p.gone)
+	st.Denied += int(p.denied)
+	st.LongLines = int(p.longLines)
+	st.Binary = int(p.binary)
+	st.Changed = int(p.changed)
+	st.Retried = int(p.retried)
+	st.IOErrors = int(p.ioErrors)
+	st.Unreached = p.scheduled - p.spawned
+	st.BytesRead = atomic.LoadInt64(&p.progress.bytesRead)
+	st.Matched = len(m)
+	st.Duration = p.clock.Now().Sub(start)
+	switch {
+	case err == context.Canceled && atomic.LoadInt32(&stable) == 1:
+		st.Truncated, err = "until-stable", nil
+	case (err == context.DeadlineExceeded || err == context.Canceled) && parent.Err() == context.DeadlineExceeded:
+		st.Truncated, err = "timeout", nil
+	}
+	return m, st, err
+}
+
+// walk sends the files below roots that are to be searched on paths, and
+// counts those that are not, until ctx is done.
+func (p *pipeline) walk(ctx context.Context, roots []string, paths chan<- candidate) error {
+	q, st := p.q, &p.st
+	lastDir, lastPath := "", ""
+	for _, root := range roots {
+		var ig *ignorer
+		if q.compat == "rg" {
+			ig = newIgnorer(root, p.readFile)
+		}
+		var realRoot string
+		if q.contain {
+			realRoot = resolvePath(root)
+		}
+		err := p.walker(root, func(path string, info os.FileInfo, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil {
+				switch {
+				case vanished(err) && path != root:
+					// A root that is not there is a mistake, not a
+					// file deleted while the search ran.
+					st.Vanished++
+					return nil
+				case errors.Is(err, os.ErrPermission):
+					st.Denied++
+					return nil
+				case isTooLong(err):
+					p.tooDeep(path)
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if q.maxDepth > 0 && path != root && strings.Count(globPath(root, path), "/") >= q.maxDepth {
+					p.tooDeep(path)
+					return filepath.SkipDir
+				}
+				if ig != nil && ig.ignoredDir(path) {
+					// Rather than walk it only to ignore every file.
+					st.Ignored++
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			lastPath = path
+			st.Walked++
+			if dir := filepath.Dir(path); dir != lastDir {
+				p.progress.dir.Store(dir)
+				lastDir = dir
+			}
+			if ig != nil && ig.ignored(path) {
+				st.Ignored++
+				return nil
+			}
+			if q.own.has(info) {
+				st.Ignored++
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				st.Special++
+				return nil
+			}
+			if !q.since.IsZero() && info.ModTime().Before(q.since) {
+				st.Ignored++
+				return nil
+			}
+			if p.files == nil || !p.files.MatchString(globPath(root, path)) {
+				st.Ignored++
+				return nil
+			}
+			if q.maxMem > 0 && info.Size() > q.maxMem && !p.fitsMem(path, info.Size()) {
+				st.TooLarge++
+				return nil
+			}
+			if q.contain {
+				real, err := filepath.EvalSymlinks(path)
+				if err == nil {
+					real, err = filepath.Abs(real)
+				}
+				switch {
+				case vanished(err):
+					st.Vanished++
+					return nil
+				case err != nil || !within(realRoot, real):
+					st.Escaped++
+					return nil
+				}
+			}
+			if q.maxFiles > 0 && p.scheduled >= q.maxFiles {
+				// Counting the rest would take a walk of the whole
+				// tree, which -max-files is meant to spare.
+				st.FilesLeft = true
+				return errMaxFiles
+			}
+			if q.maxBytes > 0 && p.scheduledBytes+info.Size() > q.maxBytes {
+				st.FilesLeft = true
+				return errMaxBytes
+			}
+			select {
+			case paths <- candidate{path, info}:
+				p.scheduled++
+				p.scheduledBytes += info.Size()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+		if err != nil {
+			st.LastPath = lastPath
+			switch err {
+			case errMaxFiles:
+				st.Truncated = "max-files"
+				return nil
+			case errMaxBytes:
+				st.Truncated = "max-bytes"
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// errMaxFiles stops the walk once -max-files candidates are found, and
+// errMaxBytes once the next would take their size past -max-bytes.
+var (
+	errMaxFiles = errors.New("-max-files reached")
+	errMaxBytes = errors.New("-max-bytes reached")
+)
+
+// tooDeep counts the directory at path as left unwalked for being nested
+// too deep.
+func (p *pipeline) tooDeep(path string) {
+	if p.st.TooDeep == 0 {
+		p.st.TooDeepPath = path
+	}
+	p.st.TooDeep++
+}
+
+// read starts a reader in g for every file from paths, which sends its hit,
+// if any, on hits. Once ctx is done, the remaining files are left unread and
+// hits found are dropped.
+func (p *pipeline) read(ctx context.Context, g *errgroup.Group, paths <-chan candidate, hits chan<- hit) {
+	for cand := range paths {
+		path, size := cand.path, cand.info.Size()
+		prof := p.q.profileOf(path, size)
+		chunk := p.chunk(prof, size)
+		// A file read a chunk at a time holds only a chunk in memory.
+		held := size
+		if chunk > 0 {
+			held = chunk
+		}
+		if ctx.Err() != nil || p.mem != nil && p.mem.Acquire(ctx, held) != nil {
+			continue
+		}
+		p.spawned++
+		g.Go(func() error {
+			h, ok, err := p.matchProfiled(ctx, path, prof, chunk)
+			if p.mem != nil {
+				p.mem.Release(held)
+			}
+			switch {
+			case vanished(err):
+				atomic.AddInt64(&p.gone, 1)
+				return nil
+			case errors.Is(err, os.ErrPermission):
+				atomic.AddInt64(&p.denied, 1)
+				return nil
+			case err == errLongLines:
+				atomic.AddInt64(&p.longLines, 1)
+				return nil
+			case err == errBinary:
+				atomic.AddInt64(&p.binary, 1)
+				return nil
+			case isTransient(err):
+				atomic.AddInt64(&p.ioErrors, 1)
+				return nil
+			case err != nil:
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case hits <- h:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	}
+}
+
+// collect gathers the hits until the channel is closed, dropping those for
+// files already seen by another path, and calls found for each one kept.
+// It returns them sorted by path, after those likely defining the pattern
+// if q asks for -def.
+func (p *pipeline) collect(hits <-chan hit, found func()) []hit {
+	var m []hit
+	seen := make(map[string]bool)
+	for h := range hits {
+		rp := resolvePath(h.Path)
+		if seen[rp] {
+			p.st.Duplicates++
+			continue
+		}
+		seen[rp] = true
+		m = append(m, h)
+		atomic.AddInt64(&p.progress.hits, 1)
+		if p.q.onHit != nil {
+			p.q.onHit(h)
+		}
+		found()
+	}
+	sort.Slice(m, func(i, j int) bool {
+		if m[i].Def != m[j].Def {
+			return m[i].Def
+		}
+		return m[i].Path < m[j].Path
+	})
+	return m
+}
+
+// matchFile reads the file at path and matches the query against it,
+// returning, if it matches, the hit with the matching lines and the file's
+// digest if the query asks for them. A query listing files makes every
+// file a hit, left unread.
+func (p *pipeline) matchFile(ctx context.Context, path string) (h hit, ok bool, err error) {
+	q := p.q
+	if q.list {
+		return hit{Path: path}, true, nil
+	}
+	data, err := p.readRetrying(ctx, path)
+	changed := err == errChanged
+	if changed {
+		atomic.AddInt64(&p.changed, 1)
+		err = nil
+	}
+	if err != nil {
+		return hit{}, false, err
+	}
+	atomic.AddInt64(&p.progress.bytesRead, int64(len(data)))
+	if q.skipLong && hasLongLine(data, q.delim, q.maxLine) {
+		return hit{}, false, errLongLines
+	}
+	binary := q.binaryFiles != "text" && isBinary(data, q.delim)
+	if binary && q.binaryFiles == "without-match" {
+		return hit{}, false, errBinary
+	}
+	atomic.AddInt64(&p.progress.searched, 1)
+	ok, h.Lines = q.match(path, data)
+	if !ok {
+		return hit{}, false, nil
+	}
+	h.Path, h.Changed = path, changed
+	q.settle(&h, binary)
+	if p.blamer != nil && len(h.Lines) > 0 {
+		p.blamer.annotate(ctx, path, data, h.Lines)
+	}
+	if q.hash != "" {
+		d := hashes[q.hash]()
+		d.Write(data)
+		h.Sum, h.Hash = hex.EncodeToString(d.Sum(nil)), q.hash
+	}
+	return h, true, nil
+}
+
+// settle leaves h, a hit in a file that is binary or not, with the lines q
+// reports.
+func (q *query) settle(h *hit, binary bool) {
+	if q.def {
+		for _, l := range h.Lines {
+			h.Def = h.Def || l.Def
+		}
+		if !q.lineNumbers {
+			h.Lines = nil
+		}
+	}
+	if binary {
+		h.Lines, h.Binary = nil, true
+	}
+}
+
+// readRetrying reads the file at path, and tries again as many times as q
+// asks while the read fails with a transient error, backing off between
+// tries. It gives up with ctx's error if ctx is done while it waits.
+func (p *pipeline) readRetrying(ctx context.Context, path string) ([]byte, error) {
+	data, err := p.readFile(path)
+	wait := p.q.retryBackoff
+	for i := 0; i < p.q.retries && isTransient(err); i++ {
+		atomic.AddInt64(&p.retried, 1)
+		if err := p.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		wait *= 2
+		data, err = p.readFile(path)
+	}
+	return data, err
+}
+
+// sleep waits for d on p's clock, or until ctx is done.
+func (p *pipeline) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	done := make(chan struct{})
+	t := p.clock.AfterFunc(d, func() { close(done) })
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
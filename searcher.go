@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// maxPatterns bounds the file patterns a searcher keeps compiled.
+const maxPatterns = 64
+
+// A searcher runs successive searches that share its walker, and with it
+// any directory listings the walker caches, and the file patterns compiled
+// for earlier searches, and what git blame told them. Searches read files
+// with its readFile, or a chunk at a time with its open, and take the time
+// from its clock. It is safe for concurrent use.
+type searcher struct {
+	walk     walker
+	readFile func(path string) ([]byte, error)
+	open     func(path string) (io.ReadCloser, error) // nil if files are only read whole
+	clock    clock
+
+	// ignore, if set, is told the files each search leaves out as
+	// rtgrep's own.
+	ignore func(paths []string)
+
+	// blamer keeps what git blame told earlier searches.
+	blamer *blamer
+
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// newSearcher returns a searcher that walks the file tree with walk.
+func newSearcher(walk walker) *searcher {
+	return &searcher{walk: walk, readFile: readDisk, open: openDisk, clock: realClock{}, blamer: newBlamer(), patterns: make(map[string]*regexp.Regexp)}
+}
+
+// search is search, with the file pattern of q compiled once per searcher.
+func (s *searcher) search(ctx context.Context, roots []string, q *query) ([]hit, stats, error) {
+	if q.files == nil {
+		p, err := s.pattern(q.filepattern)
+		if err != nil {
+			return nil, stats{}, err
+		}
+		q.files = p
+	}
+	if s.ignore != nil && len(q.own.paths) > 0 {
+		s.ignore(q.own.paths)
+	}
+	p := newPipeline(q, s.walk, s.readFile)
+	p.open, p.clock = s.open, s.clock
+	if p.blamer != nil {
+		p.blamer = s.blamer
+	}
+	return p.run(ctx, roots)
+}
+
+// pattern returns the compiled file pattern p.
+func (s *searcher) pattern(p string) (*regexp.Regexp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.patterns[p]; ok {
+		return g, nil
+	}
+	g, err := compileGlob(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.patterns) >= maxPatterns {
+		s.patterns = make(map[string]*regexp.Regexp)
+	}
+	s.patterns[p] = g
+	return g, nil
+}
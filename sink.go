@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sink is where the results of a search go. Every -sink gets them all.
+type sink interface {
+	// found is called with each hit as the search finds it.
+	found(h hit) error
+
+	// finish is called once the search is over, with all its hits, sorted
+	// by path, and its stats. It releases what the sink holds.
+	finish(m []hit, st stats) error
+}
+
+// sinkFlags is the flag.Value of -sink, which can be given several times.
+type sinkFlags []string
+
+func (f *sinkFlags) String() string { return strings.Join(*f, " ") }
+
+func (f *sinkFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// parseSink returns the sink that spec describes: a kind, optionally
+// followed by a colon and comma-separated key=value options. file and url
+// take the rest of spec as their value, commas and all, so they come last.
+//
+//	text[:file=path]            the usual output, to stdout by default
+//	json[:file=path]            a JSON object per line for each hit and one for the stats
+//	http:[batch=n,]url=address  the JSON lines POSTed in batches of n hits, 100 by default
+//	by-ext[:file=path]          the files and lines with hits per file extension
+func parseSink(spec string, lineNumbers bool) (sink, error) {
+	kind, opts, err := sinkOptions(spec)
+	if err != nil {
+		return nil, err
+	}
+	allow := func(keys ...string) error {
+		for k := range opts {
+			ok := false
+			for _, key := range keys {
+				ok = ok || k == key
+			}
+			if !ok {
+				return fmt.Errorf("bad -sink %q: %s takes no %s", spec, kind, k)
+			}
+		}
+		return nil
+	}
+	open := func() (io.WriteCloser, error) {
+		if opts["file"] == "" {
+			return nopCloser{os.Stdout}, nil
+		}
+		return os.Create(opts["file"])
+	}
+	switch kind {
+	case "text":
+		if err := allow("file"); err != nil {
+			return nil, err
+		}
+		w, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &textSink{w: w, lineNumbers: lineNumbers}, nil
+	case "json":
+		if err := allow("file"); err != nil {
+			return nil, err
+		}
+		w, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSink{w: w, enc: json.NewEncoder(w)}, nil
+	case "by-ext":
+		if err := allow("file"); err != nil {
+			return nil, err
+		}
+		w, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &extSink{w: w}, nil
+	case "http":
+		if err := allow("url", "batch"); err != nil {
+			return nil, err
+		}
+		if opts["url"] == "" {
+			return nil, fmt.Errorf("bad -sink %q: http needs a url", spec)
+		}
+		batch := 100
+		if b, ok := opts["batch"]; ok {
+			n, err := strconv.Atoi(b)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad -sink %q: batch must be a positive number", spec)
+			}
+			batch = n
+		}
+		return newHTTPSink(opts["url"], batch), nil
+	}
+	return nil, fmt.Errorf("bad -sink %q: unknown kind %q", spec, kind)
+}
+
+// sinkOptions splits spec into the sink's kind and its options.
+func sinkOptions(spec string) (kind string, opts map[string]string, err error) {
+	kind, rest := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, rest = spec[:i], spec[i+1:]
+	}
+	opts = make(map[string]string)
+	for rest != "" {
+		kv := rest
+		rest = ""
+		if i := strings.IndexByte(kv, '='); i >= 0 && kv[:i] != "file" && kv[:i] != "url" {
+			if j := strings.IndexByte(kv, ','); j >= 0 {
+				kv, rest = kv[:j], kv[j+1:]
+			}
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return "", nil, fmt.Errorf("bad -sink %q: want key=value, not %q", spec, kv)
+		}
+		opts[kv[:i]] = kv[i+1:]
+	}
+	return kind, opts, nil
+}
+
+// files returns the files the sinks in f write to.
+func (f sinkFlags) files() []string {
+	var files []string
+	for _, spec := range f {
+		if _, opts, err := sinkOptions(spec); err == nil && opts["file"] != "" {
+			files = append(files, opts["file"])
+		}
+	}
+	return files
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// textSink writes the usual output: the paths of the matching files, or
+// with line numbers their matching lines, and the number of hits. If the
+// pattern matches everything, as matchesEverything tells with
+// summarizeAbove, it writes the summary by extension instead, which says
+// more than a list burying the terminal.
+type textSink struct {
+	w              io.WriteCloser
+	lineNumbers    bool
+	summarizeAbove int
+}
+
+func (s *textSink) found(hit) error { return nil }
+
+func (s *textSink) finish(m []hit, st stats) error {
+	if matchesEverything(m, st, s.summarizeAbove) {
+		return (&extSink{w: s.w}).finish(m, st)
+	}
+	for _, h := range m {
+		if h.Sum != "" {
+			fmt.Fprintf(s.w, "%s  %s\n", h.Sum, h.Path)
+		}
+		if !s.lineNumbers {
+			if h.Sum == "" {
+				fmt.Fprintln(s.w, h.Path)
+			}
+			continue
+		}
+		if h.Binary {
+			fmt.Fprintf(s.w, "Binary file %s matches\n", h.Path)
+			continue
+		}
+		for _, l := range h.Lines {
+			if b := l.Blame; b != nil {
+				fmt.Fprintf(s.w, "%s:%d:%.8s (%s %s):%s\n", h.Path, l.N, b.Commit, b.Author, b.Date.Format("2006-01-02"), l.Text)
+				continue
+			}
+			fmt.Fprintf(s.w, "%s:%d:%s\n", h.Path, l.N, l.Text)
+		}
+	}
+	_, err := fmt.Fprintln(s.w, len(m), "hits")
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// everythingShare is the share of the files searched which, matching,
+// makes a pattern match everything.
+const everythingShare = 0.9
+
+// matchesEverything reports whether the hits m, more than above, are of
+// nearly every file searched. Files listed without being searched do not
+// count.
+func matchesEverything(m []hit, st stats, above int) bool {
+	return above > 0 && len(m) > above && st.Searched > 0 && float64(len(m)) >= everythingShare*float64(st.Searched)
+}
+
+// extSink writes a summary of the hits by file extension, the extensions
+// with the most files first, so that it shows at a glance where the
+// pattern turns up: in 3 .go files, say, and 214 generated .pb.go files.
+type extSink struct {
+	w io.WriteCloser
+}
+
+func (s *extSink) found(hit) error { return nil }
+
+func (s *extSink) finish(m []hit, st stats) error {
+	type count struct {
+		ext          string
+		files, lines int
+	}
+	var total count
+	byExt := make(map[string]*count)
+	var counts []*count
+	for _, h := range m {
+		ext := groupExt(h.Path)
+		c := byExt[ext]
+		if c == nil {
+			c = &count{ext: ext}
+			byExt[ext] = c
+			counts = append(counts, c)
+		}
+		c.files++
+		c.lines += len(h.Lines)
+		total.files++
+		total.lines += len(h.Lines)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].files != counts[j].files {
+			return counts[i].files > counts[j].files
+		}
+		return counts[i].ext < counts[j].ext
+	})
+	fmt.Fprintf(s.w, "%7s %7s  %s\n", "files", "lines", "extension")
+	for _, c := range counts {
+		ext := c.ext
+		if ext == "" {
+			ext = "(none)"
+		}
+		fmt.Fprintf(s.w, "%7d %7d  %s\n", c.files, c.lines, ext)
+	}
+	_, err := fmt.Fprintf(s.w, "%7d %7d  total\n", total.files, total.lines)
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// groupExt returns the extension of the file at path, for the summary by
+// extension. A short word before the last extension is taken to be part of
+// it, so that generated and minified files, *.pb.go or *.min.js, and
+// compressed archives, *.tar.gz, are counted apart from the rest.
+func groupExt(path string) string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	if ext == "" || ext == name {
+		return ""
+	}
+	rest := strings.TrimSuffix(name, ext)
+	inner := filepath.Ext(rest)
+	if inner == "" || inner == rest || len(inner) > 5 || strings.Trim(inner[1:], "abcdefghijklmnopqrstuvwxyz") != "" {
+		return ext
+	}
+	return inner + ext
+}
+
+// json and http sinks write a line of JSON for each hit, a sinkHit, and at
+// the end one for the stats, a sinkStats.
+type sinkHit struct {
+	Type string `json:"type"` // "hit"
+	hit
+}
+
+type sinkStats struct {
+	Type  string `json:"type"` // "stats"
+	Stats stats  `json:"stats"`
+}
+
+// jsonSink writes a sinkHit per line for each hit as it is found, and a
+// sinkStats at the end.
+type jsonSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func (s *jsonSink) found(h hit) error { return s.enc.Encode(sinkHit{"hit", h}) }
+
+func (s *jsonSink) finish(m []hit, st stats) error {
+	err := s.enc.Encode(sinkStats{"stats", st})
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+const (
+	// httpSinkTimeout bounds each POST of an http sink.
+	httpSinkTimeout = 10 * time.Second
+
+	// httpSinkQueue is how many hits an http sink holds for its sender
+	// before it drops them.
+	httpSinkQueue = 1000
+)
+
+// httpSink POSTs the lines a jsonSink would write to url, as
+// application/x-ndjson, a batch of hits at a time, with the stats in the
+// last batch. The hits are queued for a goroutine of its own to send, so
+// that a slow server does not hold up the search; once the queue is full,
+// hits are dropped, and counted in finish's error.
+type httpSink struct {
+	url     string
+	batch   int
+	client  *http.Client
+	hits    chan hit
+	dropped int
+
+	// The sender's, until done is closed.
+	done chan struct{}
+	buf  bytes.Buffer
+	n    int   // hits in buf
+	err  error // the first failure, after which nothing more is sent
+}
+
+func newHTTPSink(url string, batch int) *httpSink {
+	s := &httpSink{
+		url:    url,
+		batch:  batch,
+		client: &http.Client{Timeout: httpSinkTimeout},
+		hits:   make(chan hit, httpSinkQueue),
+		done:   make(chan struct{}),
+	}
+	go s.send()
+	return s
+}
+
+func (s *httpSink) found(h hit) error {
+	select {
+	case s.hits <- h:
+	default:
+		s.dropped++
+	}
+	return nil
+}
+
+// send posts the queued hits in batches until the queue is closed.
+func (s *httpSink) send() {
+	defer close(s.done)
+	for h := range s.hits {
+		if s.err != nil {
+			continue
+		}
+		if s.err = json.NewEncoder(&s.buf).Encode(sinkHit{"hit", h}); s.err != nil {
+			continue
+		}
+		s.n++
+		if s.n >= s.batch {
+			s.err = s.post()
+		}
+	}
+}
+
+func (s *httpSink) finish(m []hit, st stats) error {
+	close(s.hits)
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	if err := json.NewEncoder(&s.buf).Encode(sinkStats{"stats", st}); err != nil {
+		return err
+	}
+	if err := s.post(); err != nil {
+		return err
+	}
+	if s.dropped > 0 {
+		return fmt.Errorf("dropped %d hits while %s was slow to take them", s.dropped, s.url)
+	}
+	return nil
+}
+
+// post sends what is buffered.
+func (s *httpSink) post() error {
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(s.buf.Bytes()))
+	s.buf.Reset()
+	s.n = 0
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// A fanout passes results on to several sinks, and keeps the first error
+// of each, so that one failing sink does not keep the results from the
+// others.
+type fanout struct {
+	sinks []sink
+	names []string
+	errs  []error
+}
+
+func (f *fanout) add(name string, s sink) {
+	f.sinks = append(f.sinks, s)
+	f.names = append(f.names, name)
+	f.errs = append(f.errs, nil)
+}
+
+func (f *fanout) found(h hit) {
+	for i, s := range f.sinks {
+		if f.errs[i] == nil {
+			f.errs[i] = s.found(h)
+		}
+	}
+}
+
+// finish finishes every sink, and returns the sinks' errors as one, or nil.
+func (f *fanout) finish(m []hit, st stats) error {
+	var msgs []string
+	for i, s := range f.sinks {
+		err := f.errs[i]
+		if ferr := s.finish(m, st); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("-sink %s: %v", f.names[i], err))
+		}
+	}
+	if msgs != nil {
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
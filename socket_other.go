@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// privateToSelf reports whether the file of info is private to the user
+// running rtgrep, which this platform leaves to the permissions of the
+// user's temporary directory.
+func privateToSelf(info os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,24 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isStale reports whether err is a stale NFS file handle.
+func isStale(err error) bool {
+	return errors.Is(err, syscall.ESTALE)
+}
+
+// isTooLong reports whether err is for a path too long to look up.
+func isTooLong(err error) bool {
+	return errors.Is(err, syscall.ENAMETOOLONG) || errors.Is(err, errTooLong)
+}
+
+// isTransient reports whether err is an I/O error or a timeout, as reads
+// on NFS and SMB mounts sporadically fail with, and worth retrying.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, errTransient)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "errors"
+
+// isStale reports whether err is a stale NFS file handle, which Plan 9
+// does not have.
+func isStale(err error) bool {
+	return false
+}
+
+// isTooLong reports whether err is for a path too long to look up, which
+// Plan 9 does not tell apart from other errors, except in replays of
+// searches recorded elsewhere.
+func isTooLong(err error) bool {
+	return errors.Is(err, errTooLong)
+}
+
+// isTransient reports whether err is worth retrying, which on Plan 9 no
+// read error is known to be, except in replays of searches recorded
+// elsewhere.
+func isTransient(err error) bool {
+	return errors.Is(err, errTransient)
+}
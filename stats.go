@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stats describes how a search went.
+type stats struct {
+	Walked   int `json:"walked"`   // files, other than directories, the walk reached
+	Searched int `json:"searched"` // files read and matched against the pattern
+	Matched  int `json:"matched"`  // files with hits
+	Vanished int `json:"vanished"` // files and directories gone between listing and reading
+	Retried  int `json:"retried"`  // reads tried again after a transient error
+	Changed  int `json:"changed"`  // files that changed while they were read
+
+	// Files not searched, by reason.
+	Ignored   int `json:"ignored"`   // name or age outside -filepattern or -since, or ignored by -compat rg, an ignored directory counting once
+	Special   int `json:"special"`   // devices, pipes, sockets and symlinks
+	Denied    int `json:"denied"`    // files and directories not readable for lack of permission
+	TooLarge  int `json:"tooLarge"`  // files larger than -max-mem
+	LongLines int `json:"longLines"` // files with a line longer than -max-line-length
+	Binary    int `json:"binary"`    // files skipped by -binary-files without-match
+	IOErrors  int `json:"ioErrors"`  // files whose reads kept failing with I/O errors or timeouts, -retries and all
+	Unreached int `json:"unreached"` // candidate files not yet read when the search stopped early
+	Escaped   int `json:"escaped"`   // files leading out of their root, with -contain
+
+	// FilesLeft is set if -max-files or -max-bytes stopped the walk at a
+	// candidate file beyond the cap. How many more there were is not
+	// counted: that would take the walk of the rest of the tree the cap is
+	// there to spare.
+	FilesLeft bool `json:"filesLeft,omitempty"`
+
+	// TooDeep counts the directories left unwalked because they are
+	// nested deeper than -max-depth, or their paths are too long, and
+	// TooDeepPath is the first of them.
+	TooDeep     int    `json:"tooDeep"`
+	TooDeepPath string `json:"tooDeepPath,omitempty"`
+
+	// LastPath is the last file the walk reached, if it stopped before
+	// the end.
+	LastPath string `json:"lastPath,omitempty"`
+
+	BytesRead int64 `json:"bytesRead"`
+
+	// Duplicates counts hits dropped because another path led to the
+	// same file, and CollapsedRoots roots dropped because they were inside
+	// another root.
+	Duplicates     int `json:"duplicates"`
+	CollapsedRoots int `json:"collapsedRoots"`
+
+	// Duration is how long the search took, in JSON as durationMs, in
+	// milliseconds.
+	Duration time.Duration `json:"-"`
+
+	// Truncated tells why the search stopped before covering every
+	// candidate file: timeout, until-stable, max-files or max-bytes. It is
+	// empty if the search ran to completion.
+	Truncated string `json:"truncated,omitempty"`
+}
+
+// MarshalJSON encodes st with its Duration in milliseconds.
+func (st stats) MarshalJSON() ([]byte, error) {
+	type plain stats
+	return json.Marshal(struct {
+		plain
+		DurationMs float64 `json:"durationMs"`
+	}{plain(st), float64(st.Duration) / float64(time.Millisecond)})
+}
+
+// UnmarshalJSON decodes st as MarshalJSON encodes it.
+func (st *stats) UnmarshalJSON(data []byte) error {
+	type plain stats
+	v := struct {
+		*plain
+		DurationMs float64 `json:"durationMs"`
+	}{plain: (*plain)(st)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	st.Duration = time.Duration(v.DurationMs * float64(time.Millisecond))
+	return nil
+}
+
+// print writes st in the format of -stats.
+func (st *stats) print(w io.Writer) {
+	fmt.Fprintf(w, "files: %d walked, %d searched, %d matched, %d vanished\n",
+		st.Walked, st.Searched, st.Matched, st.Vanished)
+	if st.FilesLeft {
+		fmt.Fprintln(w, "files left unvisited at the cap: some, not counted")
+	}
+	fmt.Fprintf(w, "not searched: %d ignored, %d special, %d permission denied, %d too large, %d long lines, %d binary, %d I/O errors, %d unreached, %d outside the root\n",
+		st.Ignored, st.Special, st.Denied, st.TooLarge, st.LongLines, st.Binary, st.IOErrors, st.Unreached, st.Escaped)
+	fmt.Fprintf(w, "directories too deep: %d\n", st.TooDeep)
+	fmt.Fprintf(w, "bytes read: %d, %d reads retried, %d files changed while read\n", st.BytesRead, st.Retried, st.Changed)
+	fmt.Fprintf(w, "collapsed: %d duplicate hits, %d overlapping roots\n", st.Duplicates, st.CollapsedRoots)
+	fmt.Fprintf(w, "duration: %v\n", st.Duration)
+	if st.LastPath != "" {
+		fmt.Fprintf(w, "walk stopped after: %s\n", st.LastPath)
+	}
+	if st.Truncated != "" {
+		fmt.Fprintf(w, "truncated: %s\n", st.Truncated)
+	} else {
+		fmt.Fprintln(w, "truncated: no")
+	}
+}
+
+// add adds to st the counts of o, a search of other roots, such as those
+// on another host. Duration becomes the longer of the two, Truncated and
+// TooDeepPath are those of the first search to have them, and LastPath is
+// dropped, since the walks did not stop at one place.
+func (st *stats) add(o stats) {
+	st.Walked += o.Walked
+	st.Searched += o.Searched
+	st.Matched += o.Matched
+	st.Vanished += o.Vanished
+	st.Retried += o.Retried
+	st.Changed += o.Changed
+	st.Ignored += o.Ignored
+	st.Special += o.Special
+	st.Denied += o.Denied
+	st.TooLarge += o.TooLarge
+	st.LongLines += o.LongLines
+	st.Binary += o.Binary
+	st.IOErrors += o.IOErrors
+	st.Unreached += o.Unreached
+	st.Escaped += o.Escaped
+	st.FilesLeft = st.FilesLeft || o.FilesLeft
+	st.BytesRead += o.BytesRead
+	st.Duplicates += o.Duplicates
+	st.CollapsedRoots += o.CollapsedRoots
+	if st.TooDeep == 0 {
+		st.TooDeepPath = o.TooDeepPath
+	}
+	st.TooDeep += o.TooDeep
+	if o.Duration > st.Duration {
+		st.Duration = o.Duration
+	}
+	if st.Truncated == "" {
+		st.Truncated = o.Truncated
+	}
+	st.LastPath = ""
+}
+
+// skips lists the nonzero counts of files not searched, by reason, for the
+// summary line. It is empty if nothing was left out.
+func (st *stats) skips() string {
+	var s []string
+	for _, b := range []struct {
+		n    int
+		name string
+	}{
+		{st.Denied, "permission denied"},
+		{st.Special, "special"},
+		{st.TooLarge, "too large"},
+		{st.LongLines, "long lines"},
+		{st.Binary, "binary"},
+		{st.IOErrors, "I/O errors"},
+		{st.Ignored, "ignored"},
+		{st.Unreached, "unreached"},
+		{st.Escaped, "outside the root"},
+	} {
+		if b.n > 0 {
+			s = append(s, fmt.Sprintf("%d %s", b.n, b.name))
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+// coverage counts the top-level entries of roots, the files and
+// directories directly inside them or the roots themselves if they are not
+// directories, and how many of them the walk got through before it stopped
+// after st.LastPath. Roots are walked in order, and each directory in the
+// order of the names in it.
+func (st *stats) coverage(roots []string, readDir func(dir string) ([]os.FileInfo, error)) (covered, total int) {
+	stopped := false
+	for _, root := range roots {
+		list, err := readDir(root)
+		if err != nil {
+			// A file, or a directory that could not be listed.
+			total++
+			if !stopped {
+				covered++
+				stopped = root == st.LastPath
+			}
+			continue
+		}
+		total += len(list)
+		if stopped {
+			continue
+		}
+		rel, err := filepath.Rel(root, st.LastPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			covered += len(list)
+			continue
+		}
+		top := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+		for _, info := range list {
+			if info.Name() < top || info.Name() == top && !info.IsDir() {
+				covered++
+			}
+		}
+		stopped = true
+	}
+	return covered, total
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// progress is what a running search has done so far. search keeps it up to
+// date for status dumps; its fields are accessed atomically.
+type progress struct {
+	dir       atomic.Value // string: the directory the walk is in
+	searched  int64
+	bytesRead int64
+	hits      int64
+
+	// estimate is how many files the search is expected to read, 0 if
+	// unknown. It is set before the search starts.
+	estimate float64
+}
+
+// print writes a one-line snapshot of p at now, with the time taken since
+// start, the time the rest of the estimated files will take at the rate
+// they have been searched so far, and, if ctx has a deadline, the time
+// left until it.
+func (p *progress) print(w io.Writer, ctx context.Context, start, now time.Time) {
+	dir, _ := p.dir.Load().(string)
+	searched := atomic.LoadInt64(&p.searched)
+	elapsed := now.Sub(start)
+	s := fmt.Sprintf("status: in %s, %d files searched, %d bytes read, %d hits, %v elapsed",
+		dir, searched, atomic.LoadInt64(&p.bytesRead), atomic.LoadInt64(&p.hits),
+		elapsed.Round(time.Millisecond))
+	switch {
+	case p.estimate == 0 || searched == 0:
+	case float64(searched) >= p.estimate:
+		s += fmt.Sprintf(", past the estimate of %.0f files", p.estimate)
+	default:
+		eta := time.Duration((p.estimate - float64(searched)) / float64(searched) * float64(elapsed))
+		s += fmt.Sprintf(", about %v to go for an estimated %.0f files", eta.Round(time.Second), p.estimate)
+	}
+	if d, ok := ctx.Deadline(); ok {
+		s += fmt.Sprintf(", timeout in %v", d.Sub(now).Round(time.Millisecond))
+	}
+	fmt.Fprintln(w, s)
+}
+
+// reportStatus prints p to w whenever the status signal arrives, until ctx
+// is done, the way dd does on SIGUSR1. After that the signal is ignored:
+// left to its default action, it would kill rtgrep while the hits are still
+// being written out.
+func reportStatus(ctx context.Context, p *progress, w io.Writer) {
+	start := time.Now()
+	sig := make(chan os.Signal, 1)
+	if !notifyStatus(sig) {
+		return
+	}
+	go func() {
+		defer signal.Ignore(statusSignal)
+		for {
+			select {
+			case <-sig:
+				p.print(w, ctx, start, time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
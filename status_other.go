@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// statusSignal is nil: there is no status signal on this platform.
+var statusSignal os.Signal
+
+// notifyStatus reports that there is no status signal on this platform.
+func notifyStatus(c chan<- os.Signal) bool {
+	return false
+}
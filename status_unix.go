@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// statusSignal asks a running search for its status.
+var statusSignal os.Signal = syscall.SIGUSR1
+
+// notifyStatus relays statusSignal to c.
+func notifyStatus(c chan<- os.Signal) bool {
+	signal.Notify(c, statusSignal)
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeLayouts are the layouts -since and -until accept, besides durations
+// meaning that long ago.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimeFlag parses the value of -since or -until: a time in one of
+// timeLayouts, in local time unless it says otherwise, or a duration before
+// now such as 90m.
+func parseTimeFlag(name, s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad -%s %q: want a duration or a time like 2006-01-02 15:04:05", name, s)
+}
+
+// recordTime parses the timestamp at the start of a record, written in
+// layout. Timestamps may be a little shorter or longer than layout itself,
+// for example with zone names or fractional seconds, so prefixes of
+// several lengths are tried, longest first.
+func recordTime(record []byte, layout string) (time.Time, bool) {
+	max := len(layout) + 16
+	if max > len(record) {
+		max = len(record)
+	}
+	for n := max; n >= len(layout)/2 && n > 0; n-- {
+		if t, err := time.ParseInLocation(layout, string(record[:n]), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// inWindow reports whether record has a timestamp in q's time layout that
+// lies within [q.since, q.until].
+func (q *query) inWindow(record []byte) bool {
+	t, ok := recordTime(record, q.timeLayout)
+	if !ok {
+		return false
+	}
+	return (q.since.IsZero() || !t.Before(q.since)) && (q.until.IsZero() || !t.After(q.until))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -record writes a trace of a search: the request, every file and error
+// the walk reported and every file read, with its content, each with the
+// time it happened. -replay runs the search again on the trace instead of
+// the disk, on a virtual clock that shows the recorded times as the events
+// are replayed, so that a search cut short by its deadline is cut short at
+// the same point.
+//
+// A trace is a gob stream of a traceHeader followed by traceEvents.
+
+const traceVersion = 1
+
+type traceHeader struct {
+	Version int
+	Request request
+	Start   time.Time
+}
+
+// A traceEvent is one call of the walk's function or one file read.
+type traceEvent struct {
+	At   time.Duration // since the search started
+	Read bool          // a read rather than a walk entry
+	Root string        // the root walked, for walk entries
+	Path string
+	Info *traceInfo // nil for reads and for walk entries without one
+	Err  *traceError
+	Data []byte // what the read returned
+
+	seq int // the event's place in the trace, set by readTrace
+}
+
+// A traceInfo is the recorded os.FileInfo of a walk entry.
+type traceInfo struct {
+	FileName string
+	FileSize int64
+	FileMode os.FileMode
+	Modified time.Time
+}
+
+func newTraceInfo(info os.FileInfo) *traceInfo {
+	return &traceInfo{info.Name(), info.Size(), info.Mode(), info.ModTime()}
+}
+
+func (i *traceInfo) Name() string       { return i.FileName }
+func (i *traceInfo) Size() int64        { return i.FileSize }
+func (i *traceInfo) Mode() os.FileMode  { return i.FileMode }
+func (i *traceInfo) ModTime() time.Time { return i.Modified }
+func (i *traceInfo) IsDir() bool        { return i.FileMode.IsDir() }
+func (i *traceInfo) Sys() interface{}   { return nil }
+
+// A traceError is a recorded error, with as much of its meaning as search
+// looks at.
+type traceError struct {
+	Msg  string
+	Kind string // "vanished", "permission", "changed", "transient", "toolong" or ""
+}
+
+// errTransient and errTooLong stand in, in replays, for the transient I/O
+// errors and too long paths of the recorded search, which isTransient and
+// isTooLong know on every platform.
+var (
+	errTransient = errors.New("transient I/O error")
+	errTooLong   = errors.New("path too long")
+)
+
+func newTraceError(err error) *traceError {
+	switch {
+	case err == nil:
+		return nil
+	case err == errChanged:
+		return &traceError{err.Error(), "changed"}
+	case vanished(err):
+		return &traceError{err.Error(), "vanished"}
+	case errors.Is(err, os.ErrPermission):
+		return &traceError{err.Error(), "permission"}
+	case isTransient(err):
+		return &traceError{err.Error(), "transient"}
+	case isTooLong(err):
+		return &traceError{err.Error(), "toolong"}
+	}
+	return &traceError{err.Error(), ""}
+}
+
+// err returns the error e records, or nil if e is nil.
+func (e *traceError) err() error {
+	if e == nil {
+		return nil
+	}
+	switch e.Kind {
+	case "changed":
+		return errChanged
+	case "vanished":
+		return &replayedError{e.Msg, os.ErrNotExist}
+	case "permission":
+		return &replayedError{e.Msg, os.ErrPermission}
+	case "transient":
+		return &replayedError{e.Msg, errTransient}
+	case "toolong":
+		return &replayedError{e.Msg, errTooLong}
+	}
+	return errors.New(e.Msg)
+}
+
+type replayedError struct {
+	msg string
+	err error
+}
+
+func (e *replayedError) Error() string { return e.msg }
+func (e *replayedError) Unwrap() error { return e.err }
+
+// A recorder writes a trace of the walks and reads going through it. It is
+// safe for concurrent use.
+type recorder struct {
+	clock clock
+	start time.Time
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *gob.Encoder
+	err error
+}
+
+// newRecorder returns a recorder writing the trace of the search r,
+// starting now by clk, to w.
+func newRecorder(w io.Writer, r *request, clk clock) *recorder {
+	rec := &recorder{clock: clk, start: clk.Now(), w: bufio.NewWriter(w)}
+	rec.enc = gob.NewEncoder(rec.w)
+	rec.err = rec.enc.Encode(&traceHeader{traceVersion, *r, rec.start})
+	return rec
+}
+
+func (rec *recorder) record(e traceEvent) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.err == nil {
+		e.At = rec.clock.Now().Sub(rec.start)
+		rec.err = rec.enc.Encode(&e)
+	}
+}
+
+// walker returns walk, recording what it reports.
+func (rec *recorder) walker(walk walker) walker {
+	return func(root string, fn walkFunc) error {
+		return walk(root, func(path string, info os.FileInfo, err error) error {
+			e := traceEvent{Root: root, Path: path, Err: newTraceError(err)}
+			if info != nil {
+				e.Info = newTraceInfo(info)
+			}
+			rec.record(e)
+			return fn(path, info, err)
+		})
+	}
+}
+
+// readFile returns readFile, recording what it returns.
+func (rec *recorder) readFile(readFile func(path string) ([]byte, error)) func(path string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		data, err := readFile(path)
+		rec.record(traceEvent{Read: true, Path: path, Data: data, Err: newTraceError(err)})
+		return data, err
+	}
+}
+
+// flush writes out what is buffered of the trace, and returns the first
+// error writing it.
+func (rec *recorder) flush() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.w.Flush(); rec.err == nil {
+		rec.err = err
+	}
+	return rec.err
+}
+
+// replayGrace is how long a replayed event waits for the events recorded
+// before it. A replay can take a different turn from the recorded search,
+// which then never reaches some recorded events; the events after them go
+// ahead once they have waited this long.
+const replayGrace = 200 * time.Millisecond
+
+// A replay is a recorded search, to be run again with its walk and read
+// functions and on its clock. Walks and reads are replayed in the order
+// they were recorded in, so that the deadline and other timers fire between
+// the same events as they did in the recorded search.
+type replay struct {
+	header traceHeader
+	clock  *virtualClock
+	walks  map[string][]traceEvent // by root
+
+	mu    sync.Mutex
+	reads map[string][]traceEvent // by path, those not yet replayed
+	next  int                     // the seq of the event whose turn it is
+	turns map[int]chan struct{}   // closed once it is an event's turn
+}
+
+// readTrace reads a trace written by a recorder. A trace cut short, as when
+// rtgrep was killed while recording, is replayed as far as it goes.
+func readTrace(r io.Reader) (*replay, error) {
+	dec := gob.NewDecoder(bufio.NewReader(r))
+	rp := &replay{
+		walks: make(map[string][]traceEvent),
+		reads: make(map[string][]traceEvent),
+		turns: make(map[int]chan struct{}),
+	}
+	if err := dec.Decode(&rp.header); err != nil {
+		return nil, fmt.Errorf("bad trace: %v", err)
+	}
+	if rp.header.Version != traceVersion {
+		return nil, fmt.Errorf("trace version %d, want %d", rp.header.Version, traceVersion)
+	}
+	rp.clock = newVirtualClock(rp.header.Start)
+	for seq := 0; ; seq++ {
+		var e traceEvent
+		err := dec.Decode(&e)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad trace: %v", err)
+		}
+		e.seq = seq
+		if e.Read {
+			rp.reads[e.Path] = append(rp.reads[e.Path], e)
+		} else {
+			rp.walks[e.Root] = append(rp.walks[e.Root], e)
+		}
+	}
+	return rp, nil
+}
+
+// loadTrace reads the trace in the file name.
+func loadTrace(name string) (*replay, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rp, err := readTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return rp, nil
+}
+
+// replayEvent waits for e's turn, or for replayGrace, moves the clock on to
+// the time of e, and passes the turn on.
+func (rp *replay) replayEvent(e traceEvent) {
+	rp.mu.Lock()
+	if e.seq > rp.next {
+		turn := rp.turns[e.seq]
+		if turn == nil {
+			turn = make(chan struct{})
+			rp.turns[e.seq] = turn
+		}
+		rp.mu.Unlock()
+		select {
+		case <-turn:
+		case <-time.After(replayGrace):
+		}
+		rp.mu.Lock()
+	}
+	rp.clock.advanceTo(rp.header.Start.Add(e.At))
+	if e.seq >= rp.next {
+		rp.next = e.seq + 1
+		for seq, turn := range rp.turns {
+			if seq <= rp.next {
+				close(turn)
+				delete(rp.turns, seq)
+			}
+		}
+	}
+	rp.mu.Unlock()
+}
+
+// walk is the walker replaying the recorded walk of root.
+func (rp *replay) walk(root string, fn walkFunc) error {
+	skip := "" // a directory skipped, with a separator at the end
+	for _, e := range rp.walks[root] {
+		if skip != "" && strings.HasPrefix(e.Path, skip) {
+			continue
+		}
+		rp.replayEvent(e)
+		var info os.FileInfo
+		if e.Info != nil {
+			info = e.Info
+		}
+		err := fn(e.Path, info, e.Err.err())
+		if err == filepath.SkipDir && info != nil && info.IsDir() {
+			skip = e.Path + string(filepath.Separator)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile replays the recorded read of path. A file the recorded search
+// did not read is taken for one that vanished.
+func (rp *replay) readFile(path string) ([]byte, error) {
+	rp.mu.Lock()
+	reads := rp.reads[path]
+	if len(reads) == 0 {
+		rp.mu.Unlock()
+		return nil, &os.PathError{Op: "replay", Path: path, Err: os.ErrNotExist}
+	}
+	e := reads[0]
+	rp.reads[path] = reads[1:]
+	rp.mu.Unlock()
+	rp.replayEvent(e)
+	return e.Data, e.Err.err()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events that make a cached listing stale:
+// entries appearing, disappearing or changing, content and all, since the
+// listing holds their sizes and modification times, and the directory
+// itself going away.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR
+
+// newWatcher starts watching directories with inotify. The returned watch
+// function adds a directory; invalidate is called with it and the name of
+// the entry in it that changed, or "" if it changed itself, and
+// invalidateAll if the kernel dropped events.
+func newWatcher(invalidate func(dir, name string), invalidateAll func()) (watch func(dir string) error, err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	dirs := make(map[int32]string)
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				invalidateAll()
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+				if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					invalidateAll()
+					continue
+				}
+				mu.Lock()
+				dir, ok := dirs[ev.Wd]
+				if ev.Mask&syscall.IN_IGNORED != 0 {
+					delete(dirs, ev.Wd)
+				}
+				mu.Unlock()
+				if ok {
+					invalidate(dir, string(bytes.TrimRight(name, "\x00")))
+				}
+			}
+		}
+	}()
+
+	return func(dir string) error {
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		dirs[int32(wd)] = dir
+		mu.Unlock()
+		return nil
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newWatcher reports that directories cannot be watched on this platform,
+// leaving the dirCache to revalidate them periodically.
+func newWatcher(invalidate func(dir, name string), invalidateAll func()) (watch func(dir string) error, err error) {
+	return nil, errors.New("not supported on this platform")
+}